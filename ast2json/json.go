@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 
+	"../jsonutil"
 	"../lexer"
 	"../parser"
 )
@@ -12,6 +13,7 @@ var tokenOp map[lexer.TokenType]string = map[lexer.TokenType]string{
 	lexer.STRING:   "string",
 	lexer.NUMBER:   "number",
 	lexer.NIL:      "nil",
+	lexer.VARAGS:   "...",
 	lexer.ASSIGN:   "=",
 	lexer.PLUS:     "+",
 	lexer.MINUS:    "-",
@@ -25,19 +27,44 @@ var tokenOp map[lexer.TokenType]string = map[lexer.TokenType]string{
 	lexer.GREATER:  ">",
 	lexer.GREATERQ: ">=",
 	lexer.EQ:       "==",
+	lexer.NOTEQ:    "~=",
 	lexer.AND:      "and",
 	lexer.OR:       "or",
+	lexer.IDIV:     "//",
+	lexer.BAND:     "&",
+	lexer.BOR:      "|",
+	lexer.BXOR:     "~",
+	lexer.SHL:      "<<",
+	lexer.SHR:      ">>",
 	lexer.UMINUS:   "-",
 	lexer.NOT:      "not",
-	lexer.HTAG:     "#"}
+	lexer.HTAG:     "#",
+	lexer.BNOT:     "~"}
+
+// Options controls what is emitted besides the tree itself
+type Options struct {
+	// Locations adds a "Loc" object with the source range to every node
+	Locations bool
+	// Comments adds a "Comments" object to the statements and table fields with comments around them,
+	// the tokens must come from a lexer keeping trivia
+	Comments bool
+	// Shebang is written as the "Shebang" of the Program when it is not empty,
+	// it is the first line of the script returned by Parser.Shebang
+	Shebang string
+}
 
 type VisitorJSON struct {
 	indent int
 	writer io.Writer
+	opts   Options
 }
 
 func NewJSONVisitor(writer io.Writer) *VisitorJSON {
-	return &VisitorJSON{0, writer}
+	return NewJSONVisitorWithOptions(writer, Options{})
+}
+
+func NewJSONVisitorWithOptions(writer io.Writer, opts Options) *VisitorJSON {
+	return &VisitorJSON{0, writer, opts}
 }
 
 func (v *VisitorJSON) checkAndAccept(node parser.Node) {
@@ -50,17 +77,42 @@ func (v *VisitorJSON) checkAndAccept(node parser.Node) {
 
 func (v *VisitorJSON) VisitSimpleExpr(expr *parser.SimpleExpr) {
 	io.WriteString(v.writer, "{")
+	v.writeLoc(expr)
 	io.WriteString(v.writer, "\"ExpressionType\": \"SimpleExpression\",")
-	io.WriteString(v.writer, fmt.Sprintf("\"ValueType\": \"%s\",", tokenOp[expr.Type]))
-	io.WriteString(v.writer, fmt.Sprintf("\"Value\": \"%s\"", expr.Val))
+	io.WriteString(v.writer, "\"ValueType\": "+jsonutil.String(tokenOp[expr.Type])+",")
+	io.WriteString(v.writer, "\"Value\": "+jsonutil.String(expr.Val))
+	jsonutil.WriteBytes(v.writer, expr.Val)
+	io.WriteString(v.writer, "}")
+
+}
+
+func (v *VisitorJSON) VisitNumberLiteral(expr *parser.NumberLiteral) {
+	io.WriteString(v.writer, "{")
+	v.writeLoc(expr)
+	io.WriteString(v.writer, "\"ExpressionType\": \"NumberLiteral\",")
+	io.WriteString(v.writer, "\"Raw\": "+jsonutil.String(expr.Raw)+",")
+	io.WriteString(v.writer, fmt.Sprintf("\"IsInteger\": %t,", expr.IsInteger))
+	if expr.IsImaginary {
+		io.WriteString(v.writer, "\"IsImaginary\": true,")
+	}
+	io.WriteString(v.writer, fmt.Sprintf("\"Value\": %s", jsonutil.Number(expr.Number)))
 	io.WriteString(v.writer, "}")
+}
 
+func (v *VisitorJSON) VisitParenExpr(expr *parser.ParenExpr) {
+	io.WriteString(v.writer, "{")
+	v.writeLoc(expr)
+	io.WriteString(v.writer, "\"ExpressionType\": \"ParenExpression\",")
+	io.WriteString(v.writer, "\"Expression\": ")
+	v.checkAndAccept(expr.Expr)
+	io.WriteString(v.writer, "}")
 }
 
 func (v *VisitorJSON) VisitUnaryExpr(expr *parser.UnaryExpr) {
 	io.WriteString(v.writer, "{")
+	v.writeLoc(expr)
 	io.WriteString(v.writer, "\"ExpressionType\": \"UnaryExpression\",")
-	io.WriteString(v.writer, fmt.Sprintf("\"Operator\": \"%s\",", tokenOp[expr.Op]))
+	io.WriteString(v.writer, "\"Operator\": "+jsonutil.String(tokenOp[expr.Op])+",")
 	io.WriteString(v.writer, "\"Operand\": ")
 	v.checkAndAccept(expr.Operand)
 	io.WriteString(v.writer, "}")
@@ -68,8 +120,9 @@ func (v *VisitorJSON) VisitUnaryExpr(expr *parser.UnaryExpr) {
 
 func (v *VisitorJSON) VisitBinExpr(expr *parser.BinExpr) {
 	io.WriteString(v.writer, "{")
+	v.writeLoc(expr)
 	io.WriteString(v.writer, "\"ExpressionType\": \"BinaryExpression\",")
-	io.WriteString(v.writer, fmt.Sprintf("\"Operator\": \"%s\",", tokenOp[expr.Op]))
+	io.WriteString(v.writer, "\"Operator\": "+jsonutil.String(tokenOp[expr.Op])+",")
 	io.WriteString(v.writer, "\"LeftOperand\": ")
 	v.checkAndAccept(expr.Left)
 	io.WriteString(v.writer, ",")
@@ -80,13 +133,15 @@ func (v *VisitorJSON) VisitBinExpr(expr *parser.BinExpr) {
 
 func (v *VisitorJSON) VisitIdentifier(id *parser.Identifier) {
 	io.WriteString(v.writer, "{")
+	v.writeLoc(id)
 	io.WriteString(v.writer, "\"ExpressionType\": \"Identifier\",")
-	io.WriteString(v.writer, fmt.Sprintf("\"Name\": \"%s\"", id.Name))
+	io.WriteString(v.writer, "\"Name\": "+jsonutil.String(id.Name))
 	io.WriteString(v.writer, "}")
 }
 
 func (v *VisitorJSON) VisitConstructorExpr(expr *parser.ConstructorExpr) {
 	io.WriteString(v.writer, "{")
+	v.writeLoc(expr)
 	io.WriteString(v.writer, "\"ExpressionType\": \"ConstructorExpression\",")
 	io.WriteString(v.writer, "\"FieldList\": [")
 	for i := range expr.FieldList {
@@ -102,6 +157,7 @@ func (v *VisitorJSON) VisitConstructorExpr(expr *parser.ConstructorExpr) {
 
 func (v *VisitorJSON) VisitIndexExpr(expr *parser.IndexExpr) {
 	io.WriteString(v.writer, "{")
+	v.writeLoc(expr)
 	io.WriteString(v.writer, "\"ExpressionType\": \"IndexExpression\",")
 	io.WriteString(v.writer, "\"BaseExpression\": ")
 	v.checkAndAccept(expr.Base)
@@ -113,6 +169,7 @@ func (v *VisitorJSON) VisitIndexExpr(expr *parser.IndexExpr) {
 
 func (v *VisitorJSON) VisitMemberExpr(expr *parser.MemberExpr) {
 	io.WriteString(v.writer, "{")
+	v.writeLoc(expr)
 	io.WriteString(v.writer, "\"ExpressionType\": \"MemberExpression\",")
 	io.WriteString(v.writer, "\"Object\": ")
 	v.checkAndAccept(expr.Obj)
@@ -124,6 +181,7 @@ func (v *VisitorJSON) VisitMemberExpr(expr *parser.MemberExpr) {
 
 func (v *VisitorJSON) VisitKeyExpr(expr *parser.KeyExpr) {
 	io.WriteString(v.writer, "{")
+	v.writeLoc(expr)
 	io.WriteString(v.writer, "\"ExpressionType\": \"KeyExpression\",")
 	io.WriteString(v.writer, "\"Key\": ")
 	v.checkAndAccept(expr.LeftExpr)
@@ -135,7 +193,11 @@ func (v *VisitorJSON) VisitKeyExpr(expr *parser.KeyExpr) {
 
 func (v *VisitorJSON) VisitProgram(program parser.Program) {
 	io.WriteString(v.writer, "{")
+	v.writeLoc(program)
 	io.WriteString(v.writer, "\"ExpressionType\": \"Program\",")
+	if v.opts.Shebang != "" {
+		io.WriteString(v.writer, "\"Shebang\": "+jsonutil.String(v.opts.Shebang)+",")
+	}
 	io.WriteString(v.writer, "\"Statements\": [")
 	for i := range program {
 		v.checkAndAccept(program[i])
@@ -147,13 +209,14 @@ func (v *VisitorJSON) VisitProgram(program parser.Program) {
 	io.WriteString(v.writer, "}")
 }
 
-func (v *VisitorJSON) VisitArgList(l parser.ArgList) {
+func (v *VisitorJSON) VisitArgList(l *parser.ArgList) {
 	io.WriteString(v.writer, "{")
+	v.writeLoc(l)
 	io.WriteString(v.writer, "\"ExpressionType\": \"ArgumentList\",")
 	io.WriteString(v.writer, "\"Arguments\": [")
-	for i := range l {
-		v.checkAndAccept(l[i])
-		if i != len(l)-1 {
+	for i := range l.Args {
+		v.checkAndAccept(l.Args[i])
+		if i != len(l.Args)-1 {
 			io.WriteString(v.writer, ", ")
 		}
 	}
@@ -161,13 +224,14 @@ func (v *VisitorJSON) VisitArgList(l parser.ArgList) {
 	io.WriteString(v.writer, "}")
 }
 
-func (v *VisitorJSON) VisitReturnList(l parser.ReturnList) {
+func (v *VisitorJSON) VisitReturnList(l *parser.ReturnList) {
 	io.WriteString(v.writer, "{")
+	v.writeLoc(l)
 	io.WriteString(v.writer, "\"ExpressionType\": \"ReturnList\",")
 	io.WriteString(v.writer, "\"ReturnValues\": [")
-	for i := range l {
-		v.checkAndAccept(l[i])
-		if i != len(l)-1 {
+	for i := range l.Exprs {
+		v.checkAndAccept(l.Exprs[i])
+		if i != len(l.Exprs)-1 {
 			io.WriteString(v.writer, ", ")
 		}
 	}
@@ -177,6 +241,7 @@ func (v *VisitorJSON) VisitReturnList(l parser.ReturnList) {
 
 func (v *VisitorJSON) VisitCallExpr(expr *parser.CallExpr) {
 	io.WriteString(v.writer, "{")
+	v.writeLoc(expr)
 	io.WriteString(v.writer, "\"ExpressionType\": \"CallExpression\",")
 	io.WriteString(v.writer, "\"Base\": ")
 	v.checkAndAccept(expr.Base)
@@ -186,31 +251,52 @@ func (v *VisitorJSON) VisitCallExpr(expr *parser.CallExpr) {
 	io.WriteString(v.writer, "}")
 }
 
+func (v *VisitorJSON) VisitMethodCallExpr(expr *parser.MethodCallExpr) {
+	io.WriteString(v.writer, "{")
+	v.writeLoc(expr)
+	io.WriteString(v.writer, "\"ExpressionType\": \"MethodCallExpression\",")
+	io.WriteString(v.writer, "\"Receiver\": ")
+	v.checkAndAccept(expr.Receiver)
+	io.WriteString(v.writer, ",")
+	io.WriteString(v.writer, "\"Method\": ")
+	v.checkAndAccept(expr.Method)
+	io.WriteString(v.writer, ",")
+	io.WriteString(v.writer, "\"Argument\": ")
+	v.checkAndAccept(expr.Arguments)
+	io.WriteString(v.writer, "}")
+}
+
 func (v *VisitorJSON) VisitFunction(f *parser.Function) {
 	io.WriteString(v.writer, "{")
+	v.writeLoc(f)
 	io.WriteString(v.writer, "\"ExpressionType\": \"UnnamedFunction\",")
 	io.WriteString(v.writer, "\"Parameters\": ")
 	v.checkAndAccept(f.Parameters)
 	io.WriteString(v.writer, ",")
+	v.writeSignature(f.TypeSignature)
 	v.body2JSON(f.Body)
 	io.WriteString(v.writer, "}")
 }
 
 func (v *VisitorJSON) VisitNamedFunction(f *parser.NamedFunction) {
 	io.WriteString(v.writer, "{")
+	v.writeLoc(f)
 	io.WriteString(v.writer, "\"ExpressionType\": \"Function\",")
 	io.WriteString(v.writer, "\"Name\": ")
 	v.checkAndAccept(f.FunctionName)
 	io.WriteString(v.writer, ",")
+	io.WriteString(v.writer, fmt.Sprintf("\"IsMethod\": %t,", f.IsMethod))
 	io.WriteString(v.writer, "\"Parameters\": ")
 	v.checkAndAccept(f.Parameters)
 	io.WriteString(v.writer, ",")
+	v.writeSignature(f.TypeSignature)
 	v.body2JSON(f.Body)
 	io.WriteString(v.writer, "}")
 }
 
 func (v *VisitorJSON) VisitLocalFunction(f *parser.LocalFunction) {
 	io.WriteString(v.writer, "{")
+	v.writeLoc(f)
 	io.WriteString(v.writer, "\"ExpressionType\": \"LocalFunction\",")
 	io.WriteString(v.writer, "\"Name\": ")
 	v.checkAndAccept(f.FunctionName)
@@ -218,12 +304,14 @@ func (v *VisitorJSON) VisitLocalFunction(f *parser.LocalFunction) {
 	io.WriteString(v.writer, "\"Parameters\": ")
 	v.checkAndAccept(f.Parameters)
 	io.WriteString(v.writer, ",")
+	v.writeSignature(f.TypeSignature)
 	v.body2JSON(f.Body)
 	io.WriteString(v.writer, "}")
 }
 
 func (v *VisitorJSON) VisitAssignmentExpr(expr *parser.AssignmentExpr) {
 	io.WriteString(v.writer, "{")
+	v.writeLoc(expr)
 	io.WriteString(v.writer, "\"ExpressionType\": \"AssignmentExpression\",")
 	io.WriteString(v.writer, "\"Variables\": [")
 	for i := range expr.Vars {
@@ -235,7 +323,7 @@ func (v *VisitorJSON) VisitAssignmentExpr(expr *parser.AssignmentExpr) {
 	io.WriteString(v.writer, "],")
 	io.WriteString(v.writer, "\"Expressions\": [")
 	for i := range expr.Exprs {
-		expr.Exprs[i].AcceptVisitor(v)
+		v.checkAndAccept(expr.Exprs[i])
 		if i != len(expr.Exprs)-1 {
 			io.WriteString(v.writer, ", ")
 		}
@@ -246,6 +334,7 @@ func (v *VisitorJSON) VisitAssignmentExpr(expr *parser.AssignmentExpr) {
 
 func (v *VisitorJSON) VisitLocalAssignmentExpr(expr *parser.LocalAssignmentExpr) {
 	io.WriteString(v.writer, "{")
+	v.writeLoc(expr)
 	io.WriteString(v.writer, "\"ExpressionType\": \"LocalAssignmentExpression\",")
 	io.WriteString(v.writer, "\"Variables\": [")
 	for i := range expr.Vars {
@@ -255,6 +344,23 @@ func (v *VisitorJSON) VisitLocalAssignmentExpr(expr *parser.LocalAssignmentExpr)
 		}
 	}
 	io.WriteString(v.writer, "],")
+	if parser.AnyType(expr.Types) {
+		io.WriteString(v.writer, "\"Types\": ")
+		v.list2JSON(expr.Types)
+		io.WriteString(v.writer, ",")
+	}
+	io.WriteString(v.writer, "\"Attributes\": [")
+	for i := range expr.Vars {
+		if i < len(expr.Attribs) && expr.Attribs[i] != "" {
+			io.WriteString(v.writer, jsonutil.String(expr.Attribs[i]))
+		} else {
+			io.WriteString(v.writer, "null")
+		}
+		if i != len(expr.Vars)-1 {
+			io.WriteString(v.writer, ", ")
+		}
+	}
+	io.WriteString(v.writer, "],")
 	io.WriteString(v.writer, "\"Expressions\": [")
 	for i := range expr.Exprs {
 		v.checkAndAccept(expr.Exprs[i])
@@ -268,6 +374,7 @@ func (v *VisitorJSON) VisitLocalAssignmentExpr(expr *parser.LocalAssignmentExpr)
 
 func (v *VisitorJSON) VisitDoStmnt(st *parser.DoStmnt) {
 	io.WriteString(v.writer, "{")
+	v.writeLoc(st)
 	io.WriteString(v.writer, "\"ExpressionType\": \"DoStatement\",")
 	v.body2JSON(st.Block)
 	io.WriteString(v.writer, "}")
@@ -275,6 +382,7 @@ func (v *VisitorJSON) VisitDoStmnt(st *parser.DoStmnt) {
 
 func (v *VisitorJSON) VisitWhileStmnt(st *parser.WhileStmnt) {
 	io.WriteString(v.writer, "{")
+	v.writeLoc(st)
 	io.WriteString(v.writer, "\"ExpressionType\": \"WhileStatement\",")
 	io.WriteString(v.writer, "\"Condition\": ")
 	v.checkAndAccept(st.Condition)
@@ -290,12 +398,20 @@ func (v *VisitorJSON) VisitWhileStmnt(st *parser.WhileStmnt) {
 	io.WriteString(v.writer, "}")
 }
 
-func (v *VisitorJSON) VisitRepeatStmnt(*parser.RepeatStmnt) {
-	// TO DO
+func (v *VisitorJSON) VisitRepeatStmnt(st *parser.RepeatStmnt) {
+	io.WriteString(v.writer, "{")
+	v.writeLoc(st)
+	io.WriteString(v.writer, "\"ExpressionType\": \"RepeatStatement\",")
+	io.WriteString(v.writer, "\"Condition\": ")
+	v.checkAndAccept(st.Condition)
+	io.WriteString(v.writer, ",")
+	v.body2JSON(st.Block)
+	io.WriteString(v.writer, "}")
 }
 
 func (v *VisitorJSON) VisitIfStmnt(st *parser.IfStmnt) {
 	io.WriteString(v.writer, "{")
+	v.writeLoc(st)
 	io.WriteString(v.writer, "\"ExpressionType\": \"IfStatement\",")
 	io.WriteString(v.writer, "\"Clauses\": ")
 	v.checkAndAccept(st.Clauses)
@@ -304,6 +420,7 @@ func (v *VisitorJSON) VisitIfStmnt(st *parser.IfStmnt) {
 
 func (v *VisitorJSON) VisitIfClause(st *parser.IfClause) {
 	io.WriteString(v.writer, "{")
+	v.writeLoc(st)
 	io.WriteString(v.writer, "\"ExpressionType\": \"IfClauseStatement\",")
 	io.WriteString(v.writer, "\"Condition\": ")
 	v.checkAndAccept(st.Condition)
@@ -314,6 +431,7 @@ func (v *VisitorJSON) VisitIfClause(st *parser.IfClause) {
 
 func (v *VisitorJSON) VisitElseIfClause(st *parser.ElseIfClause) {
 	io.WriteString(v.writer, "{")
+	v.writeLoc(st)
 	io.WriteString(v.writer, "\"ExpressionType\": \"ElseIfClauseStatement\",")
 	io.WriteString(v.writer, "\"Condition\": ")
 	v.checkAndAccept(st.Condition)
@@ -324,19 +442,24 @@ func (v *VisitorJSON) VisitElseIfClause(st *parser.ElseIfClause) {
 
 func (v *VisitorJSON) VisitElseClause(st *parser.ElseClause) {
 	io.WriteString(v.writer, "{")
+	v.writeLoc(st)
 	io.WriteString(v.writer, "\"ExpressionType\": \"ElseClauseStatement\",")
 	v.body2JSON(st.Block)
 	io.WriteString(v.writer, "}")
 }
 
-func (v *VisitorJSON) VisitForStmnt(st *parser.ForStmnt) {
+func (v *VisitorJSON) VisitNumericForStmnt(st *parser.NumericForStmnt) {
 	io.WriteString(v.writer, "{")
+	v.writeLoc(st)
 	io.WriteString(v.writer, "\"ExpressionType\": \"ForStatement\",")
+	io.WriteString(v.writer, "\"Variable\": ")
+	v.checkAndAccept(st.Var)
+	io.WriteString(v.writer, ",")
 	io.WriteString(v.writer, "\"Initialization\": ")
-	v.checkAndAccept(st.Start)
+	v.checkAndAccept(st.Init)
 	io.WriteString(v.writer, ",")
 	io.WriteString(v.writer, "\"Condition\": ")
-	v.checkAndAccept(st.Condition)
+	v.checkAndAccept(st.Limit)
 	io.WriteString(v.writer, ",")
 	io.WriteString(v.writer, "\"Iteration\": ")
 	v.checkAndAccept(st.Step)
@@ -345,6 +468,98 @@ func (v *VisitorJSON) VisitForStmnt(st *parser.ForStmnt) {
 	io.WriteString(v.writer, "}")
 }
 
+func (v *VisitorJSON) VisitForInStmnt(st *parser.ForInStmnt) {
+	io.WriteString(v.writer, "{")
+	v.writeLoc(st)
+	io.WriteString(v.writer, "\"ExpressionType\": \"ForInStatement\",")
+	io.WriteString(v.writer, "\"Names\": [")
+	for i := range st.Names {
+		v.checkAndAccept(st.Names[i])
+		if i != len(st.Names)-1 {
+			io.WriteString(v.writer, ", ")
+		}
+	}
+	io.WriteString(v.writer, "],")
+	io.WriteString(v.writer, "\"Expressions\": [")
+	for i := range st.Exprs {
+		v.checkAndAccept(st.Exprs[i])
+		if i != len(st.Exprs)-1 {
+			io.WriteString(v.writer, ", ")
+		}
+	}
+	io.WriteString(v.writer, "],")
+	v.body2JSON(st.Block)
+	io.WriteString(v.writer, "}")
+}
+
+func (v *VisitorJSON) VisitGotoStmnt(st *parser.GotoStmnt) {
+	io.WriteString(v.writer, "{")
+	v.writeLoc(st)
+	io.WriteString(v.writer, "\"ExpressionType\": \"GotoStatement\",")
+	io.WriteString(v.writer, "\"Label\": ")
+	v.checkAndAccept(st.Label)
+	io.WriteString(v.writer, "}")
+}
+
+func (v *VisitorJSON) VisitLabelStmnt(st *parser.LabelStmnt) {
+	io.WriteString(v.writer, "{")
+	v.writeLoc(st)
+	io.WriteString(v.writer, "\"ExpressionType\": \"LabelStatement\",")
+	io.WriteString(v.writer, "\"Name\": ")
+	v.checkAndAccept(st.Name)
+	io.WriteString(v.writer, "}")
+}
+
+func (v *VisitorJSON) VisitErrorNode(e *parser.ErrorNode) {
+	io.WriteString(v.writer, "{")
+	v.writeLoc(e)
+	io.WriteString(v.writer, "\"ExpressionType\": \"Error\",")
+	if e.Err != nil {
+		io.WriteString(v.writer, "\"Message\": "+jsonutil.String(e.Err.Error()))
+	} else {
+		io.WriteString(v.writer, "\"Message\": null")
+	}
+	io.WriteString(v.writer, "}")
+}
+
+// writeLoc writes the comments and the location of the node, when the options ask for them
+func (v *VisitorJSON) writeLoc(node parser.Node) {
+	span := node.NodeSpan()
+	if v.opts.Comments && span.Comments != nil {
+		io.WriteString(v.writer, "\"Comments\": {\"Leading\": ")
+		v.writeComments(span.Comments.Leading)
+		io.WriteString(v.writer, ", \"Inner\": ")
+		v.writeComments(span.Comments.Inner)
+		io.WriteString(v.writer, ", \"Trailing\": ")
+		v.writeComments(span.Comments.Trailing)
+		io.WriteString(v.writer, "},")
+	}
+	if !v.opts.Locations {
+		return
+	}
+	io.WriteString(v.writer, "\"Loc\": {\"Start\": ")
+	v.writePosition(span.Start)
+	io.WriteString(v.writer, ", \"End\": ")
+	v.writePosition(span.End)
+	io.WriteString(v.writer, "},")
+}
+
+// writeComments writes the comments as they are in the source
+func (v *VisitorJSON) writeComments(comments []lexer.Token) {
+	io.WriteString(v.writer, "[")
+	for i, c := range comments {
+		if i > 0 {
+			io.WriteString(v.writer, ", ")
+		}
+		io.WriteString(v.writer, jsonutil.String(c.Raw))
+	}
+	io.WriteString(v.writer, "]")
+}
+
+func (v *VisitorJSON) writePosition(pos lexer.Position) {
+	io.WriteString(v.writer, fmt.Sprintf("{\"Line\": %d, \"Column\": %d, \"Offset\": %d}", pos.Line, pos.Col, pos.Offset))
+}
+
 func (v *VisitorJSON) body2JSON(block []parser.Node) {
 	io.WriteString(v.writer, "\"Body\": [")
 	for i := range block {
@@ -0,0 +1,209 @@
+package ast2json
+
+import (
+	"fmt"
+	"io"
+
+	"../jsonutil"
+	"../parser"
+)
+
+func (v *VisitorJSON) VisitContinueStmnt(st *parser.ContinueStmnt) {
+	io.WriteString(v.writer, "{")
+	v.writeLoc(st)
+	io.WriteString(v.writer, "\"ExpressionType\": \"ContinueStatement\"")
+	io.WriteString(v.writer, "}")
+}
+
+func (v *VisitorJSON) VisitCompoundAssignment(expr *parser.CompoundAssignment) {
+	io.WriteString(v.writer, "{")
+	v.writeLoc(expr)
+	io.WriteString(v.writer, "\"ExpressionType\": \"CompoundAssignmentExpression\",")
+	io.WriteString(v.writer, "\"Operator\": "+jsonutil.String(tokenOp[expr.Op]+"=")+",")
+	io.WriteString(v.writer, "\"Variable\": ")
+	v.checkAndAccept(expr.Var)
+	io.WriteString(v.writer, ",")
+	io.WriteString(v.writer, "\"Expression\": ")
+	v.checkAndAccept(expr.Expr)
+	io.WriteString(v.writer, "}")
+}
+
+func (v *VisitorJSON) VisitTypeDecl(st *parser.TypeDecl) {
+	io.WriteString(v.writer, "{")
+	v.writeLoc(st)
+	io.WriteString(v.writer, "\"ExpressionType\": \"TypeDeclaration\",")
+	io.WriteString(v.writer, fmt.Sprintf("\"Export\": %t,", st.Export))
+	io.WriteString(v.writer, "\"Name\": ")
+	v.checkAndAccept(st.Name)
+	io.WriteString(v.writer, ",")
+	io.WriteString(v.writer, "\"TypeParameters\": ")
+	v.list2JSON(st.TypeParams)
+	io.WriteString(v.writer, ",")
+	io.WriteString(v.writer, "\"Type\": ")
+	v.checkAndAccept(st.Type)
+	io.WriteString(v.writer, "}")
+}
+
+func (v *VisitorJSON) VisitIfExpr(expr *parser.IfExpr) {
+	io.WriteString(v.writer, "{")
+	v.writeLoc(expr)
+	io.WriteString(v.writer, "\"ExpressionType\": \"IfExpression\",")
+	io.WriteString(v.writer, "\"Condition\": ")
+	v.checkAndAccept(expr.Condition)
+	io.WriteString(v.writer, ",")
+	io.WriteString(v.writer, "\"Then\": ")
+	v.checkAndAccept(expr.Then)
+	io.WriteString(v.writer, ",")
+	io.WriteString(v.writer, "\"Else\": ")
+	v.checkAndAccept(expr.Else)
+	io.WriteString(v.writer, "}")
+}
+
+func (v *VisitorJSON) VisitTypeAssertion(expr *parser.TypeAssertion) {
+	io.WriteString(v.writer, "{")
+	v.writeLoc(expr)
+	io.WriteString(v.writer, "\"ExpressionType\": \"TypeAssertionExpression\",")
+	io.WriteString(v.writer, "\"Expression\": ")
+	v.checkAndAccept(expr.Expr)
+	io.WriteString(v.writer, ",")
+	io.WriteString(v.writer, "\"Type\": ")
+	v.checkAndAccept(expr.Type)
+	io.WriteString(v.writer, "}")
+}
+
+func (v *VisitorJSON) VisitNamedType(t *parser.NamedType) {
+	io.WriteString(v.writer, "{")
+	v.writeLoc(t)
+	io.WriteString(v.writer, "\"ExpressionType\": \"NamedType\",")
+	io.WriteString(v.writer, "\"Module\": ")
+	if t.Module != nil {
+		v.checkAndAccept(t.Module)
+	} else {
+		io.WriteString(v.writer, "null")
+	}
+	io.WriteString(v.writer, ",")
+	io.WriteString(v.writer, "\"Name\": ")
+	v.checkAndAccept(t.Name)
+	io.WriteString(v.writer, ",")
+	io.WriteString(v.writer, "\"Arguments\": ")
+	v.list2JSON(t.Args)
+	io.WriteString(v.writer, "}")
+}
+
+func (v *VisitorJSON) VisitOptionalType(t *parser.OptionalType) {
+	io.WriteString(v.writer, "{")
+	v.writeLoc(t)
+	io.WriteString(v.writer, "\"ExpressionType\": \"OptionalType\",")
+	io.WriteString(v.writer, "\"Type\": ")
+	v.checkAndAccept(t.Type)
+	io.WriteString(v.writer, "}")
+}
+
+func (v *VisitorJSON) VisitUnionType(t *parser.UnionType) {
+	io.WriteString(v.writer, "{")
+	v.writeLoc(t)
+	io.WriteString(v.writer, "\"ExpressionType\": \"UnionType\",")
+	io.WriteString(v.writer, "\"Types\": ")
+	v.list2JSON(t.Types)
+	io.WriteString(v.writer, "}")
+}
+
+func (v *VisitorJSON) VisitIntersectionType(t *parser.IntersectionType) {
+	io.WriteString(v.writer, "{")
+	v.writeLoc(t)
+	io.WriteString(v.writer, "\"ExpressionType\": \"IntersectionType\",")
+	io.WriteString(v.writer, "\"Types\": ")
+	v.list2JSON(t.Types)
+	io.WriteString(v.writer, "}")
+}
+
+func (v *VisitorJSON) VisitTableType(t *parser.TableType) {
+	io.WriteString(v.writer, "{")
+	v.writeLoc(t)
+	io.WriteString(v.writer, "\"ExpressionType\": \"TableType\",")
+	io.WriteString(v.writer, "\"Fields\": ")
+	v.list2JSON(t.Fields)
+	io.WriteString(v.writer, "}")
+}
+
+func (v *VisitorJSON) VisitTypeField(t *parser.TypeField) {
+	io.WriteString(v.writer, "{")
+	v.writeLoc(t)
+	io.WriteString(v.writer, "\"ExpressionType\": \"TypeField\",")
+	io.WriteString(v.writer, "\"Name\": ")
+	if t.Name != nil {
+		v.checkAndAccept(t.Name)
+	} else {
+		io.WriteString(v.writer, "null")
+	}
+	io.WriteString(v.writer, ",")
+	io.WriteString(v.writer, "\"Key\": ")
+	v.checkAndAccept(t.Key)
+	io.WriteString(v.writer, ",")
+	io.WriteString(v.writer, "\"Value\": ")
+	v.checkAndAccept(t.Value)
+	io.WriteString(v.writer, "}")
+}
+
+func (v *VisitorJSON) VisitFunctionType(t *parser.FunctionType) {
+	io.WriteString(v.writer, "{")
+	v.writeLoc(t)
+	io.WriteString(v.writer, "\"ExpressionType\": \"FunctionType\",")
+	io.WriteString(v.writer, "\"TypeParameters\": ")
+	v.list2JSON(t.TypeParams)
+	io.WriteString(v.writer, ",")
+	io.WriteString(v.writer, "\"Parameters\": ")
+	v.list2JSON(t.Params)
+	io.WriteString(v.writer, ",")
+	io.WriteString(v.writer, "\"Returns\": ")
+	v.list2JSON(t.Returns)
+	io.WriteString(v.writer, "}")
+}
+
+func (v *VisitorJSON) VisitTypeofType(t *parser.TypeofType) {
+	io.WriteString(v.writer, "{")
+	v.writeLoc(t)
+	io.WriteString(v.writer, "\"ExpressionType\": \"TypeofType\",")
+	io.WriteString(v.writer, "\"Expression\": ")
+	v.checkAndAccept(t.Expr)
+	io.WriteString(v.writer, "}")
+}
+
+func (v *VisitorJSON) VisitVariadicType(t *parser.VariadicType) {
+	io.WriteString(v.writer, "{")
+	v.writeLoc(t)
+	io.WriteString(v.writer, "\"ExpressionType\": \"VariadicType\",")
+	io.WriteString(v.writer, "\"Type\": ")
+	v.checkAndAccept(t.Type)
+	io.WriteString(v.writer, "}")
+}
+
+// writeSignature writes the Luau annotations of a function, nothing for a function without them
+func (v *VisitorJSON) writeSignature(signature parser.TypeSignature) {
+	if len(signature.TypeParams) > 0 {
+		io.WriteString(v.writer, "\"TypeParameters\": ")
+		v.list2JSON(signature.TypeParams)
+		io.WriteString(v.writer, ",")
+	}
+	if len(signature.ParamTypes) > 0 {
+		io.WriteString(v.writer, "\"ParameterTypes\": ")
+		v.list2JSON(signature.ParamTypes)
+		io.WriteString(v.writer, ",")
+	}
+	if signature.ReturnTypes != nil {
+		io.WriteString(v.writer, "\"ReturnTypes\": ")
+		v.list2JSON(signature.ReturnTypes)
+		io.WriteString(v.writer, ",")
+	}
+}
+
+func (v *VisitorJSON) list2JSON(nodes []parser.Node) {
+	io.WriteString(v.writer, "[")
+	for i := range nodes {
+		v.checkAndAccept(nodes[i])
+		if i != len(nodes)-1 {
+			io.WriteString(v.writer, ", ")
+		}
+	}
+	io.WriteString(v.writer, "]")
+}
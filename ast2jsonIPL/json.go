@@ -3,8 +3,8 @@ package ast2jsonipl
 import (
 	"fmt"
 	"io"
-	"strconv"
 
+	"../jsonutil"
 	"../lexer"
 	"../parser"
 )
@@ -25,10 +25,18 @@ var tokenOp map[lexer.TokenType]string = map[lexer.TokenType]string{
 	lexer.GREATER:  "Greater",
 	lexer.GREATERQ: "GreaterEqual",
 	lexer.EQ:       "EqualEqual",
+	lexer.NOTEQ:    "BangEqual",
 	lexer.AND:      "LogicalAnd",
 	lexer.OR:       "LogicalOr",
+	lexer.IDIV:     "IntegerDivision",
+	lexer.BAND:     "BitwiseAnd",
+	lexer.BOR:      "BitwiseOr",
+	lexer.BXOR:     "BitwiseXor",
+	lexer.SHL:      "LeftShift",
+	lexer.SHR:      "RightShift",
 	lexer.UMINUS:   "Minus",
-	lexer.NOT:      "LogicalNot"}
+	lexer.NOT:      "LogicalNot",
+	lexer.BNOT:     "BitwiseNot"}
 
 type VisitorJSON struct {
 	writer io.Writer
@@ -38,11 +46,16 @@ func NewJSONVisitor(writer io.Writer) *VisitorJSON {
 	return &VisitorJSON{writer}
 }
 
+// unsupported writes a node the IPL format has no form for
+func (v *VisitorJSON) unsupported() {
+	io.WriteString(v.writer, "{\"ExpressionType\": \"Unsupported\"}")
+}
+
 func (v *VisitorJSON) checkAndAccept(node parser.Node) {
 	if node != nil {
 		node.AcceptVisitor(v)
 	} else {
-		v.writer.Write([]byte("Null"))
+		io.WriteString(v.writer, "\"Null\"")
 	}
 }
 
@@ -54,25 +67,33 @@ func (v *VisitorJSON) VisitSimpleExpr(expr *parser.SimpleExpr) {
 		io.WriteString(v.writer, "}")
 		return
 	}
-	toNum, err := strconv.Atoi(expr.Val)
-	if err != nil {
-		io.WriteString(v.writer, "\"ExpressionType\": \"LiteralString\",")
-		io.WriteString(v.writer, fmt.Sprintf("\"Value\": \"%s\"", expr.Val))
-		io.WriteString(v.writer, "}")
-		return
-	}
+	io.WriteString(v.writer, "\"ExpressionType\": \"LiteralString\",")
+	io.WriteString(v.writer, "\"Value\": "+jsonutil.String(expr.Val))
+	jsonutil.WriteBytes(v.writer, expr.Val)
+	io.WriteString(v.writer, "}")
+}
 
+func (v *VisitorJSON) VisitNumberLiteral(expr *parser.NumberLiteral) {
+	io.WriteString(v.writer, "{")
 	io.WriteString(v.writer, "\"ExpressionType\": \"LiteralNumber\",")
-	io.WriteString(v.writer, fmt.Sprintf("\"Value\": %d", toNum))
+	if expr.IsImaginary {
+		io.WriteString(v.writer, "\"IsImaginary\": true,")
+	}
+	io.WriteString(v.writer, fmt.Sprintf("\"Value\": %s", jsonutil.Number(expr.Number)))
 	io.WriteString(v.writer, "}")
 }
 
+// VisitParenExpr writes the expression alone, the IPL format has no parentheses
+func (v *VisitorJSON) VisitParenExpr(expr *parser.ParenExpr) {
+	v.checkAndAccept(expr.Expr)
+}
+
 func (v *VisitorJSON) VisitUnaryExpr(expr *parser.UnaryExpr) {
 	io.WriteString(v.writer, "{")
 	io.WriteString(v.writer, "\"ExpressionType\": \"UnaryExpression\",")
 	io.WriteString(v.writer, "\"Expr\": ")
 	v.checkAndAccept(expr.Operand)
-	io.WriteString(v.writer, fmt.Sprintf(", \"Operator\": \"%s\"", tokenOp[expr.Op]))
+	io.WriteString(v.writer, ", \"Operator\": "+jsonutil.String(tokenOp[expr.Op]))
 	io.WriteString(v.writer, "}")
 }
 
@@ -83,27 +104,31 @@ func (v *VisitorJSON) VisitBinExpr(expr *parser.BinExpr) {
 	v.checkAndAccept(expr.Left)
 	io.WriteString(v.writer, ", \"Right\": ")
 	v.checkAndAccept(expr.Right)
-	io.WriteString(v.writer, fmt.Sprintf(", \"Operator\": \"%s\"", tokenOp[expr.Op]))
+	io.WriteString(v.writer, ", \"Operator\": "+jsonutil.String(tokenOp[expr.Op]))
 	io.WriteString(v.writer, "}")
 }
 
 func (v *VisitorJSON) VisitIdentifier(id *parser.Identifier) {
 	io.WriteString(v.writer, "{")
 	io.WriteString(v.writer, "\"ExpressionType\": \"IdentifierExpression\",")
-	io.WriteString(v.writer, fmt.Sprintf("\"Name\": \"%s\"", id.Name))
+	io.WriteString(v.writer, "\"Name\": "+jsonutil.String(id.Name))
 	io.WriteString(v.writer, "}")
 }
 
 func (v *VisitorJSON) VisitConstructorExpr(expr *parser.ConstructorExpr) {
+	v.unsupported()
 }
 
 func (v *VisitorJSON) VisitIndexExpr(expr *parser.IndexExpr) {
+	v.unsupported()
 }
 
 func (v *VisitorJSON) VisitMemberExpr(expr *parser.MemberExpr) {
+	v.unsupported()
 }
 
 func (v *VisitorJSON) VisitKeyExpr(expr *parser.KeyExpr) {
+	v.unsupported()
 }
 
 func (v *VisitorJSON) VisitProgram(program parser.Program) {
@@ -120,13 +145,13 @@ func (v *VisitorJSON) VisitProgram(program parser.Program) {
 	io.WriteString(v.writer, "}")
 }
 
-func (v *VisitorJSON) VisitArgList(l parser.ArgList) {
+func (v *VisitorJSON) VisitArgList(l *parser.ArgList) {
 	io.WriteString(v.writer, "{")
 	io.WriteString(v.writer, "\"ExpressionType\": \"ListExpression\",")
 	io.WriteString(v.writer, "\"Values\": [")
-	for i := range l {
-		v.checkAndAccept(l[i])
-		if i != len(l)-1 {
+	for i := range l.Args {
+		v.checkAndAccept(l.Args[i])
+		if i != len(l.Args)-1 {
 			io.WriteString(v.writer, ", ")
 		}
 	}
@@ -134,13 +159,13 @@ func (v *VisitorJSON) VisitArgList(l parser.ArgList) {
 	io.WriteString(v.writer, "}")
 }
 
-func (v *VisitorJSON) VisitReturnList(l parser.ReturnList) {
+func (v *VisitorJSON) VisitReturnList(l *parser.ReturnList) {
 	io.WriteString(v.writer, "{")
 	io.WriteString(v.writer, "\"ExpressionType\": \"ReturnList\",")
 	io.WriteString(v.writer, "\"ReturnValues\": [")
-	for i := range l {
-		v.checkAndAccept(l[i])
-		if i != len(l)-1 {
+	for i := range l.Exprs {
+		v.checkAndAccept(l.Exprs[i])
+		if i != len(l.Exprs)-1 {
 			io.WriteString(v.writer, ", ")
 		}
 	}
@@ -159,41 +184,72 @@ func (v *VisitorJSON) VisitCallExpr(expr *parser.CallExpr) {
 	io.WriteString(v.writer, "}")
 }
 
+func (v *VisitorJSON) VisitMethodCallExpr(expr *parser.MethodCallExpr) {
+	io.WriteString(v.writer, "{")
+	io.WriteString(v.writer, "\"ExpressionType\": \"MethodCallExpression\",")
+	io.WriteString(v.writer, "\"Object\": ")
+	v.checkAndAccept(expr.Receiver)
+	io.WriteString(v.writer, ",")
+	io.WriteString(v.writer, "\"Method\": "+jsonutil.String(expr.Method.Name)+",")
+	io.WriteString(v.writer, "\"Arguments\": ")
+	v.checkAndAccept(expr.Arguments)
+	io.WriteString(v.writer, "}")
+}
+
 func (v *VisitorJSON) VisitFunction(f *parser.Function) {
+	v.unsupported()
 }
 
 func (v *VisitorJSON) VisitNamedFunction(f *parser.NamedFunction) {
 	io.WriteString(v.writer, "{")
 	io.WriteString(v.writer, "\"ExpressionType\": \"FunctionDeclaration\",")
 	io.WriteString(v.writer, "\"Name\": ")
-	val, ok := f.FunctionName.(*parser.Identifier)
+	name, ok := functionName(f.FunctionName, f.IsMethod)
 	if ok {
-		io.WriteString(v.writer, "\""+val.Name+"\"")
+		io.WriteString(v.writer, jsonutil.String(name))
 	} else {
 		v.checkAndAccept(f.FunctionName)
 	}
 	io.WriteString(v.writer, ",")
 	io.WriteString(v.writer, "\"ArgumentsIdentifiers\": ")
-	v.writeParamList(f.Parameters)
+	v.writeParamList(f.Parameters.Args)
 	io.WriteString(v.writer, ",")
 	io.WriteString(v.writer, "\"Body\": ")
 	v.checkAndAccept(parser.Program(f.Body))
 	io.WriteString(v.writer, "}")
 }
 
+// functionName flattens a function name like a.b.c or a.b:c into a single string
+func functionName(node parser.Node, isMethod bool) (string, bool) {
+	switch n := node.(type) {
+	case *parser.Identifier:
+		return n.Name, true
+	case *parser.MemberExpr:
+		obj, ok := functionName(n.Obj, false)
+		if !ok {
+			return "", false
+		}
+		if isMethod {
+			return obj + ":" + n.Field.Name, true
+		}
+		return obj + "." + n.Field.Name, true
+	}
+	return "", false
+}
+
 func (v *VisitorJSON) VisitLocalFunction(f *parser.LocalFunction) {
 	io.WriteString(v.writer, "{")
 	io.WriteString(v.writer, "\"ExpressionType\": \"FunctionDeclaration\",")
 	io.WriteString(v.writer, "\"Name\": ")
 	val, ok := f.FunctionName.(*parser.Identifier)
 	if ok {
-		io.WriteString(v.writer, "\""+val.Name+"\"")
+		io.WriteString(v.writer, jsonutil.String(val.Name))
 	} else {
 		v.checkAndAccept(f.FunctionName)
 	}
 	io.WriteString(v.writer, ",")
 	io.WriteString(v.writer, "\"ArgumentsIdentifiers\": ")
-	v.writeParamList(f.Parameters)
+	v.writeParamList(f.Parameters.Args)
 	io.WriteString(v.writer, ",")
 	io.WriteString(v.writer, "\"Body\": ")
 	v.checkAndAccept(parser.Program(f.Body))
@@ -207,7 +263,9 @@ func (v *VisitorJSON) VisitAssignmentExpr(expr *parser.AssignmentExpr) {
 	if len(expr.Vars) > 0 {
 		simpExpr, ok := expr.Vars[0].(*parser.Identifier)
 		if ok {
-			io.WriteString(v.writer, fmt.Sprintf("\"%s\"", simpExpr.Name))
+			io.WriteString(v.writer, jsonutil.String(simpExpr.Name))
+		} else {
+			v.checkAndAccept(expr.Vars[0])
 		}
 	} else {
 		io.WriteString(v.writer, "\"Null\"")
@@ -228,7 +286,9 @@ func (v *VisitorJSON) VisitLocalAssignmentExpr(expr *parser.LocalAssignmentExpr)
 	if len(expr.Vars) > 0 {
 		simpExpr, ok := expr.Vars[0].(*parser.Identifier)
 		if ok {
-			io.WriteString(v.writer, fmt.Sprintf("\"%s\"", simpExpr.Name))
+			io.WriteString(v.writer, jsonutil.String(simpExpr.Name))
+		} else {
+			v.checkAndAccept(expr.Vars[0])
 		}
 	} else {
 		io.WriteString(v.writer, "\"Null\"")
@@ -243,6 +303,7 @@ func (v *VisitorJSON) VisitLocalAssignmentExpr(expr *parser.LocalAssignmentExpr)
 }
 
 func (v *VisitorJSON) VisitDoStmnt(st *parser.DoStmnt) {
+	v.unsupported()
 }
 
 func (v *VisitorJSON) VisitWhileStmnt(st *parser.WhileStmnt) {
@@ -256,15 +317,20 @@ func (v *VisitorJSON) VisitWhileStmnt(st *parser.WhileStmnt) {
 	io.WriteString(v.writer, "}")
 }
 
+func (v *VisitorJSON) VisitRepeatStmnt(st *parser.RepeatStmnt) {
+	v.unsupported()
+}
+
 func (v *VisitorJSON) VisitIfStmnt(st *parser.IfStmnt) {
-	argList := st.Clauses.(parser.ArgList)
-	if len(argList) == 0 {
-		//io.WriteString(v.writer, "\"Null\"")
+	clauses := st.Clauses.(*parser.ArgList).Args
+	if len(clauses) == 0 {
+		// the last clause has already written the "ElseStatement" key
+		io.WriteString(v.writer, "\"Null\"")
 		return
 	}
 	io.WriteString(v.writer, "{")
 	io.WriteString(v.writer, "\"ExpressionType\": \"IfStatement\",")
-	switch t := argList[0].(type) {
+	switch t := clauses[0].(type) {
 	case *parser.IfClause:
 		io.WriteString(v.writer, "\"Condition\": ")
 		v.checkAndAccept(t.Condition)
@@ -283,7 +349,7 @@ func (v *VisitorJSON) VisitIfStmnt(st *parser.IfStmnt) {
 		v.checkAndAccept(parser.Program(t.Block))
 		io.WriteString(v.writer, ", \"ElseStatement\": ")
 	}
-	v.VisitIfStmnt(&parser.IfStmnt{argList[1:]})
+	v.VisitIfStmnt(&parser.IfStmnt{Clauses: &parser.ArgList{Args: clauses[1:]}})
 
 	io.WriteString(v.writer, "}")
 
@@ -298,14 +364,15 @@ func (v *VisitorJSON) VisitElseIfClause(st *parser.ElseIfClause) {
 func (v *VisitorJSON) VisitElseClause(st *parser.ElseClause) {
 }
 
-func (v *VisitorJSON) VisitForStmnt(st *parser.ForStmnt) {
+func (v *VisitorJSON) VisitNumericForStmnt(st *parser.NumericForStmnt) {
 	io.WriteString(v.writer, "{")
 	io.WriteString(v.writer, "\"ExpressionType\": \"ForStatement\",")
+	io.WriteString(v.writer, "\"Variable\": "+jsonutil.String(st.Var.Name)+",")
 	io.WriteString(v.writer, "\"Initialization\": ")
-	v.checkAndAccept(st.Start)
+	v.checkAndAccept(st.Init)
 	io.WriteString(v.writer, ",")
 	io.WriteString(v.writer, "\"Condition\": ")
-	v.checkAndAccept(st.Condition)
+	v.checkAndAccept(st.Limit)
 	io.WriteString(v.writer, ",")
 	io.WriteString(v.writer, "\"Iteration\": ")
 	v.checkAndAccept(st.Step)
@@ -314,6 +381,100 @@ func (v *VisitorJSON) VisitForStmnt(st *parser.ForStmnt) {
 	io.WriteString(v.writer, "}")
 }
 
+func (v *VisitorJSON) VisitForInStmnt(st *parser.ForInStmnt) {
+	io.WriteString(v.writer, "{")
+	io.WriteString(v.writer, "\"ExpressionType\": \"ForInStatement\",")
+	io.WriteString(v.writer, "\"Names\": ")
+	v.writeParamList(st.Names)
+	io.WriteString(v.writer, ",")
+	io.WriteString(v.writer, "\"Expressions\": ")
+	v.checkAndAccept(&parser.ArgList{Args: st.Exprs})
+	io.WriteString(v.writer, ", \"Body\": ")
+	v.checkAndAccept(parser.Program(st.Block))
+	io.WriteString(v.writer, "}")
+}
+
+func (v *VisitorJSON) VisitGotoStmnt(st *parser.GotoStmnt) {
+	io.WriteString(v.writer, "{")
+	io.WriteString(v.writer, "\"ExpressionType\": \"GotoStatement\",")
+	io.WriteString(v.writer, "\"Label\": "+jsonutil.String(st.Label.Name))
+	io.WriteString(v.writer, "}")
+}
+
+func (v *VisitorJSON) VisitLabelStmnt(st *parser.LabelStmnt) {
+	io.WriteString(v.writer, "{")
+	io.WriteString(v.writer, "\"ExpressionType\": \"LabelStatement\",")
+	io.WriteString(v.writer, "\"Name\": "+jsonutil.String(st.Name.Name))
+	io.WriteString(v.writer, "}")
+}
+
+func (v *VisitorJSON) VisitContinueStmnt(st *parser.ContinueStmnt) {
+	v.unsupported()
+}
+
+func (v *VisitorJSON) VisitCompoundAssignment(expr *parser.CompoundAssignment) {
+	v.unsupported()
+}
+
+func (v *VisitorJSON) VisitTypeDecl(st *parser.TypeDecl) {
+	v.unsupported()
+}
+
+func (v *VisitorJSON) VisitIfExpr(expr *parser.IfExpr) {
+	v.unsupported()
+}
+
+func (v *VisitorJSON) VisitTypeAssertion(expr *parser.TypeAssertion) {
+	v.unsupported()
+}
+
+func (v *VisitorJSON) VisitNamedType(t *parser.NamedType) {
+	v.unsupported()
+}
+
+func (v *VisitorJSON) VisitOptionalType(t *parser.OptionalType) {
+	v.unsupported()
+}
+
+func (v *VisitorJSON) VisitUnionType(t *parser.UnionType) {
+	v.unsupported()
+}
+
+func (v *VisitorJSON) VisitIntersectionType(t *parser.IntersectionType) {
+	v.unsupported()
+}
+
+func (v *VisitorJSON) VisitTableType(t *parser.TableType) {
+	v.unsupported()
+}
+
+func (v *VisitorJSON) VisitTypeField(t *parser.TypeField) {
+	v.unsupported()
+}
+
+func (v *VisitorJSON) VisitFunctionType(t *parser.FunctionType) {
+	v.unsupported()
+}
+
+func (v *VisitorJSON) VisitTypeofType(t *parser.TypeofType) {
+	v.unsupported()
+}
+
+func (v *VisitorJSON) VisitVariadicType(t *parser.VariadicType) {
+	v.unsupported()
+}
+
+func (v *VisitorJSON) VisitErrorNode(e *parser.ErrorNode) {
+	io.WriteString(v.writer, "{")
+	io.WriteString(v.writer, "\"ExpressionType\": \"ErrorExpression\",")
+	if e.Err != nil {
+		io.WriteString(v.writer, "\"Message\": "+jsonutil.String(e.Err.Error()))
+	} else {
+		io.WriteString(v.writer, "\"Message\": \"Null\"")
+	}
+	io.WriteString(v.writer, "}")
+}
+
 func (v *VisitorJSON) body2JSON(block []parser.Node) {
 	io.WriteString(v.writer, "\"Body\": [")
 	for i := range block {
@@ -325,14 +486,14 @@ func (v *VisitorJSON) body2JSON(block []parser.Node) {
 	io.WriteString(v.writer, "]")
 }
 
-func (v *VisitorJSON) writeParamList(list parser.ArgList) {
+func (v *VisitorJSON) writeParamList(list []parser.Node) {
 	io.WriteString(v.writer, "[")
 	for i, node := range list {
 		if i == len(list)-1 {
-			io.WriteString(v.writer, "\""+node.(*parser.Identifier).Name+"\"")
+			io.WriteString(v.writer, jsonutil.String(node.(*parser.Identifier).Name))
 			break
 		}
-		io.WriteString(v.writer, "\""+node.(*parser.Identifier).Name+"\",")
+		io.WriteString(v.writer, jsonutil.String(node.(*parser.Identifier).Name)+",")
 	}
 	io.WriteString(v.writer, "]")
 }
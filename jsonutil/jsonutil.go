@@ -0,0 +1,44 @@
+// Package jsonutil holds the JSON encoding shared by the AST serializers
+package jsonutil
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"math"
+	"strings"
+	"unicode/utf8"
+
+	"../lexer"
+)
+
+// Number writes a number as JSON. Integers beyond 2^53 would lose precision in most JSON
+// readers and infinities and NaN have no JSON form, so these are written as strings instead
+func Number(num lexer.Number) string {
+	big := num.Int > 1<<53 || num.Int < -1<<53
+	if num.IsUnsigned {
+		big = uint64(num.Int) > 1<<53
+	}
+	if num.IsInteger && big || !num.IsInteger && (math.IsInf(num.Float, 0) || math.IsNaN(num.Float)) {
+		return String(num.String())
+	}
+	return num.String()
+}
+
+// String quotes s as a JSON string. Invalid UTF-8 is replaced by U+FFFD
+func String(s string) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// WriteBytes adds the base64 encoded bytes of a string that is not valid UTF-8,
+// since its JSON value cannot hold them
+func WriteBytes(w io.Writer, s string) {
+	if !utf8.ValidString(s) {
+		io.WriteString(w, ", \"Base64\": "+String(base64.StdEncoding.EncodeToString([]byte(s))))
+	}
+}
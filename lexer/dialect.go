@@ -0,0 +1,100 @@
+package lexer
+
+// Dialect selects the Lua version whose syntax is accepted.
+// The zero value is Lua54
+type Dialect int
+
+const (
+	Lua54 Dialect = iota
+	Lua53
+	Lua52
+	Lua51
+	LuaJIT
+	Luau
+)
+
+var dialectNames = map[Dialect]string{
+	Lua54:  "Lua 5.4",
+	Lua53:  "Lua 5.3",
+	Lua52:  "Lua 5.2",
+	Lua51:  "Lua 5.1",
+	LuaJIT: "LuaJIT",
+	Luau:   "Luau"}
+
+func (d Dialect) String() string {
+	if name, ok := dialectNames[d]; ok {
+		return name
+	}
+	return "<unknown dialect>"
+}
+
+// HasGoto reports whether goto is a keyword and labels are allowed
+func (d Dialect) HasGoto() bool {
+	return d != Lua51 && d != Luau
+}
+
+// HasBitwise reports whether the bitwise operators are allowed
+func (d Dialect) HasBitwise() bool {
+	return d == Lua53 || d == Lua54
+}
+
+// HasIntDiv reports whether the '//' operator is allowed
+func (d Dialect) HasIntDiv() bool {
+	return d.HasBitwise() || d == Luau
+}
+
+// HasAttribs reports whether local declarations may have <const> and <close> attributes
+func (d Dialect) HasAttribs() bool {
+	return d == Lua54
+}
+
+// HasZEscape reports whether strings may contain the \z escape
+func (d Dialect) HasZEscape() bool {
+	return d != Lua51
+}
+
+// HasHexEscape reports whether strings may contain the \xXX escape
+func (d Dialect) HasHexEscape() bool {
+	return d != Lua51
+}
+
+// HasUTF8Escape reports whether strings may contain the \u{XXX} escape
+func (d Dialect) HasUTF8Escape() bool {
+	return d != Lua51 && d != Lua52
+}
+
+// MaxUTF8Escape returns the largest value of a \u{XXX} escape, Lua 5.4 allows up to 2^31
+// while the others stop at the last Unicode code point
+func (d Dialect) MaxUTF8Escape() uint32 {
+	if d == Lua54 {
+		return 0x7FFFFFFF
+	}
+	return 0x10FFFF
+}
+
+// HasTypes reports whether the Luau type annotations, compound assignments,
+// continue and if expressions are allowed
+func (d Dialect) HasTypes() bool {
+	return d == Luau
+}
+
+// HasNumberSuffixes reports whether numbers may end with the LuaJIT LL, ULL and i suffixes
+func (d Dialect) HasNumberSuffixes() bool {
+	return d == LuaJIT
+}
+
+// supports reports whether tokens of type tt exist in the dialect
+func (d Dialect) supports(tt TokenType) bool {
+	switch tt {
+	case DBCOLON:
+		return d.HasGoto() || d.HasTypes()
+	case IDIV:
+		return d.HasIntDiv()
+	case BAND, BOR:
+		// union and intersection types
+		return d.HasBitwise() || d.HasTypes()
+	case BXOR, BNOT, SHL, SHR:
+		return d.HasBitwise()
+	}
+	return true
+}
@@ -2,6 +2,13 @@ package lexer
 
 import (
 	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 func isDigit(c byte) bool {
@@ -21,19 +28,130 @@ func isValidIdentifier(c byte) bool {
 }
 
 func isWhitespace(c byte) bool {
-	return c == ' ' || c == '\t' || c == '\n'
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
+
+func isNewline(c byte) bool {
+	return c == '\n' || c == '\r'
 }
 
 func isHex(c byte) bool {
-	return isDigit(c) || (c >= 'a' && c <= 'f')
+	_, ok := hexValue(c)
+	return ok
+}
+
+func hexValue(c byte) (uint32, bool) {
+	switch {
+	case isDigit(c):
+		return uint32(c - '0'), true
+	case c >= 'a' && c <= 'f':
+		return uint32(c-'a') + 10, true
+	case c >= 'A' && c <= 'F':
+		return uint32(c-'A') + 10, true
+	}
+	return 0, false
+}
+
+// simpleEscapes are the escape sequences standing for a single character
+var simpleEscapes = map[byte]byte{
+	'a':  '\a',
+	'b':  '\b',
+	'f':  '\f',
+	'n':  '\n',
+	'r':  '\r',
+	't':  '\t',
+	'v':  '\v',
+	'\\': '\\',
+	'"':  '"',
+	'\'': '\'',
+}
+
+// utf8Escape encodes x as Lua does for \u{XXX}, which allows surrogates and values up to 2^31
+func utf8Escape(x uint32) []byte {
+	if x < 0x80 {
+		return []byte{byte(x)}
+	}
+	var buf []byte
+	mfb := uint32(0x3f) // the largest value fitting in the first byte
+	for {
+		buf = append([]byte{byte(0x80 | x&0x3f)}, buf...)
+		x >>= 6
+		mfb >>= 1
+		if x <= mfb {
+			break
+		}
+	}
+	return append([]byte{byte(^mfb<<1 | x)}, buf...)
+}
+
+// Position is a location in the source. Line and Col start at 1, Col is counted in the ColumnUnit of the lexer.
+// Offset is the byte offset from the beginning of the source
+type Position struct {
+	Line   int
+	Col    int
+	Offset int
 }
 
-// Token represents a single token in the Lexer
+// Number is the value of a numeral. As in Lua 5.3 a numeral without a dot or exponent is an integer,
+// unless it is a decimal one too large for int64, and hexadecimal integers wrap around.
+// A LuaJIT imaginary numeral like 2i has IsImaginary set and its coefficient in Float,
+// a LuaJIT ULL numeral has IsUnsigned set and the bits of its uint64 value in Int
+type Number struct {
+	IsInteger bool
+	Int       int64
+	Float     float64
+
+	IsImaginary bool
+	IsUnsigned  bool
+}
+
+// String formats the number as Lua does, floats in the shortest form that reads back the same.
+// An imaginary number is formatted without the 'i' of its numeral
+func (n Number) String() string {
+	switch {
+	case n.IsInteger && n.IsUnsigned:
+		return strconv.FormatUint(uint64(n.Int), 10)
+	case n.IsInteger:
+		return strconv.FormatInt(n.Int, 10)
+	case math.IsInf(n.Float, 1):
+		return "inf"
+	case math.IsInf(n.Float, -1):
+		return "-inf"
+	case math.IsNaN(n.Float):
+		return "nan"
+	}
+	return strconv.FormatFloat(n.Float, 'g', -1, 64)
+}
+
+// Token represents a single token in the Lexer.
+// Start is the position of the first byte of the token, End is the position right after the last one.
+// Raw is the token as written in the source, for strings Val is the decoded value.
+// Num is the value of a NUMBER token, Trivia is only kept by a lexer created WithTrivia
 type Token struct {
-	Type  TokenType
-	Val   string
-	atRow int
-	atCol int
+	Type   TokenType
+	Val    string
+	Raw    string
+	Num    Number
+	Start  Position
+	End    Position
+	Trivia *Trivia
+}
+
+// Trivia are the COMMENT and WHITESPACE tokens around a token. Trailing holds those
+// after the token up to the end of its line, Leading all the others before it
+type Trivia struct {
+	Leading  []Token
+	Trailing []Token
+}
+
+// Error is a lexical error at a position in the source
+type Error struct {
+	Pos Position
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d:%d: %s", e.Pos.Line, e.Pos.Col, e.Msg)
 }
 
 // Lexer represents the unit which will parse the source file
@@ -42,16 +160,105 @@ type Lexer struct {
 	tokens   []Token
 	crrRow   int
 	crrCol   int
+	offset   int
 	keywords map[string]TokenType
 	i        int
+	dialect  Dialect
+	unit     ColumnUnit
+	// continuation bytes left in the current UTF-8 sequence, they take no column
+	pending int
+
+	// reader supplies the rest of the source of a streaming lexer, it is nil once exhausted
+	reader    io.Reader
+	hitEnd    bool
+	lookahead []Token
+	err       error
+
+	// trivia lexed for the next token and a token lexed while looking for trailing trivia
+	trivia  bool
+	leading []Token
+	held    *Token
+
+	// identifiers may hold Unicode letters, strings and comments must be valid UTF-8
+	unicodeIdents bool
+	validUTF8     bool
+}
+
+// Option configures a Lexer
+type Option func(*Lexer)
+
+// WithTrivia keeps the comments and whitespace in the Trivia of the tokens.
+// Run then also returns the EOF token, which holds the trivia at the end of the source
+func WithTrivia() Option {
+	return func(lex *Lexer) {
+		lex.trivia = true
+	}
+}
+
+// WithDialect makes the lexer accept the syntax of the given Lua version, Lua54 by default
+func WithDialect(d Dialect) Option {
+	return func(lex *Lexer) {
+		lex.dialect = d
+	}
+}
+
+// WithUnicodeIdentifiers makes the lexer accept Unicode letters in identifiers like LuaJIT does.
+// Digits and combining marks may follow the first character
+func WithUnicodeIdentifiers() Option {
+	return func(lex *Lexer) {
+		lex.unicodeIdents = true
+	}
+}
+
+// WithUTF8Validation makes the source of string literals and comments that is not valid UTF-8 an error,
+// positioned at the first invalid byte. Escape sequences may still produce any bytes
+func WithUTF8Validation() Option {
+	return func(lex *Lexer) {
+		lex.validUTF8 = true
+	}
+}
+
+// ColumnUnit is what Position.Col counts. A tab is a single unit like any other character
+type ColumnUnit int
+
+const (
+	Bytes ColumnUnit = iota
+	Runes
+	// UTF16 counts code units as the Language Server Protocol does, 2 for runes outside the BMP
+	UTF16
+)
+
+// WithColumnUnit sets the unit of the columns in positions, Bytes by default
+func WithColumnUnit(u ColumnUnit) Option {
+	return func(lex *Lexer) {
+		lex.unit = u
+	}
+}
+
+// width is the number of columns taken by the byte at the current position.
+// Invalid UTF-8 takes one column per byte
+func (lex *Lexer) width() int {
+	if lex.unit == Bytes {
+		return 1
+	}
+	if lex.pending > 0 {
+		lex.pending--
+		return 0
+	}
+	r, size := utf8.DecodeRuneInString(lex.src[lex.i:])
+	lex.pending = size - 1
+	if lex.unit == UTF16 && r >= 0x10000 {
+		return 2
+	}
+	return 1
 }
 
-func (lex *Lexer) prev() {
-	lex.i--
+func (lex *Lexer) position() Position {
+	return Position{Line: lex.crrRow, Col: lex.crrCol, Offset: lex.offset + lex.i}
 }
 
 // New constructs new lexer
-func (lex *Lexer) New(src string) Lexer {
+func (lex *Lexer) New(src string, opts ...Option) Lexer {
 
 	kwrds := map[string]TokenType{
 		"and":      AND,
@@ -68,6 +275,7 @@ func (lex *Lexer) New(src string) Lexer {
 		"then":     THEN,
 		"else":     ELSE,
 		"function": FUNCTION,
+		"goto":     GOTO,
 		"not":      NOT,
 		"true":     TRUE,
 		"elseif":   ELSEIF,
@@ -76,7 +284,14 @@ func (lex *Lexer) New(src string) Lexer {
 		"until":    UNTIL,
 		"while":    WHILE}
 
-	return Lexer{src: src, tokens: nil, crrRow: 0, crrCol: 0, keywords: kwrds, i: 0}
+	l := Lexer{src: src, tokens: nil, crrRow: 1, crrCol: 1, offset: 0, keywords: kwrds, i: 0}
+	for _, opt := range opts {
+		opt(&l)
+	}
+	if !l.dialect.HasGoto() {
+		delete(l.keywords, "goto")
+	}
+	return l
 }
 
 func (lex *Lexer) current() (byte, error) {
@@ -87,8 +302,10 @@ func (lex *Lexer) current() (byte, error) {
 }
 
 func (lex *Lexer) reslice() error {
+	lex.offset += lex.i
 	if lex.i >= len(lex.src) {
 		lex.src = ""
+		lex.i = 0
 		return errors.New("EOF")
 	}
 	lex.src = lex.src[lex.i:]
@@ -97,11 +314,17 @@ func (lex *Lexer) reslice() error {
 }
 
 func (lex *Lexer) next() {
-	if lex.src[0] == '\n' {
+	if lex.i >= len(lex.src) {
+		return
+	}
+	switch {
+	case lex.src[lex.i] == '\r' && lex.i+1 < len(lex.src) && lex.src[lex.i+1] == '\n':
+		// \r\n is a single line break, counted at the \n
+	case isNewline(lex.src[lex.i]):
 		lex.crrRow++
-		lex.crrCol = 0
-	} else {
-		lex.crrCol++
+		lex.crrCol = 1
+	default:
+		lex.crrCol += lex.width()
 	}
 	lex.i++
 }
@@ -109,262 +332,625 @@ func (lex *Lexer) next() {
 func (lex *Lexer) matchOne(m string) bool {
 	for i := 0; i < len(m) && len(lex.src) > lex.i; i++ {
 		if lex.src[lex.i] == m[i] {
-			lex.i++
+			lex.next()
 			return true
 		}
 	}
 	return false
 }
 
+// parseNumber reads a numeral like Lua does: it takes all the hex digits, dots and signed exponents
+// after the first digit and then checks that they form a number
 func (lex *Lexer) parseNumber() (Token, error) {
-
+	start := lex.position()
 	char, err := lex.current()
-	if err == nil && !isDigit(char) {
+	leadingDot := err == nil && char == '.' && lex.i+1 < len(lex.src) && isDigit(lex.src[lex.i+1])
+	if err != nil || (!isDigit(char) && !leadingDot) {
 		return Token{}, errors.New("not a number")
 	}
 
-	lex.next()
-
-	if lex.src[lex.i-1] == '0' && lex.matchOne("x") {
-		lex.crrCol++
-		char, err = lex.current()
-		for err == nil && isHex(char) {
+	expo := "Ee"
+	if strings.HasPrefix(lex.src[lex.i:], "0x") || strings.HasPrefix(lex.src[lex.i:], "0X") {
+		expo = "Pp"
+		lex.next()
+		lex.next()
+	}
+	for char, err = lex.current(); err == nil; char, err = lex.current() {
+		if strings.IndexByte(expo, char) >= 0 {
+			lex.next()
+			lex.matchOne("+-")
+		} else if isHex(char) || char == '.' {
 			lex.next()
-			char, err = lex.current()
+		} else {
+			break
 		}
-		num := lex.src[:lex.i]
-		lex.reslice()
-		return Token{Type: NUMBER, Val: num, atRow: lex.crrRow, atCol: lex.crrCol}, nil
 	}
 
-	dot := false
-	char, err = lex.current()
-	for err == nil && (isDigit(char) || (char == '.' && !dot)) {
-		if char == '.' {
-			dot = true
+	numeral := lex.src[:lex.i]
+	suffix, err := lex.numberSuffix()
+	if err != nil {
+		return Token{Type: INVALID, Val: lex.src[:lex.i]}, err
+	}
+	var num Number
+	ok := false
+	switch suffix {
+	case "LL", "ULL":
+		num, ok = parseInteger64(numeral)
+		num.IsUnsigned = suffix == "ULL"
+	case "I":
+		num, ok = parseNumeral(numeral)
+		if num.IsInteger {
+			num = Number{Float: float64(num.Int)}
 		}
-		lex.next()
-		char, err = lex.current()
+		num.IsImaginary = true
+	default:
+		num, ok = parseNumeral(numeral)
+	}
+	if n := lex.identifierChar(false); n > 0 {
+		// a numeral touching a letter
+		for ; n > 0; n-- {
+			lex.next()
+		}
+		ok = false
+	}
+	if !ok {
+		return Token{Type: INVALID, Val: lex.src[:lex.i]}, &Error{Pos: start, Msg: fmt.Sprintf("malformed number near '%s'", lex.src[:lex.i])}
 	}
-	num := lex.src[:lex.i]
+	text := lex.src[:lex.i]
 	lex.reslice()
-	return Token{Type: NUMBER, Val: num, atRow: lex.crrRow, atCol: lex.crrCol}, nil
+	return Token{Type: NUMBER, Val: text, Num: num}, nil
 }
 
-func (lex *Lexer) parseString() (Token, error) {
-	if !lex.matchOne("\"'[") {
-		return Token{Type: NUMBER, Val: "", atRow: lex.crrRow, atCol: lex.crrCol}, errors.New("not a string")
+// parseNumeral converts the text of a numeral without its suffix, ok is false for a malformed one
+func parseNumeral(text string) (num Number, ok bool) {
+	hex := len(text) > 1 && text[0] == '0' && (text[1] == 'x' || text[1] == 'X')
+	if hex && !strings.ContainsAny(text, ".pP") {
+		if len(text) == 2 {
+			return Number{}, false
+		}
+		var x uint64
+		for i := 2; i < len(text); i++ {
+			d, _ := hexValue(text[i])
+			x = x<<4 + uint64(d)
+		}
+		return Number{IsInteger: true, Int: int64(x)}, true
+	}
+	if !hex && !strings.ContainsAny(text, ".eE") {
+		if x, err := strconv.ParseInt(text, 10, 64); err == nil {
+			return Number{IsInteger: true, Int: x}, true
+		}
+	}
+	if hex && !strings.ContainsAny(text, "pP") {
+		// strconv needs the binary exponent of a hexadecimal float
+		text += "p0"
+	}
+	f, err := strconv.ParseFloat(text, 64)
+	if err != nil && err.(*strconv.NumError).Err != strconv.ErrRange {
+		return Number{}, false
 	}
+	return Number{Float: f}, true
+}
 
-	charM := lex.src[lex.i-1]
-	prev := charM
+// parseInteger64 converts the numeral of a LuaJIT LL or ULL integer, which keeps the low 64 bits
+// of its value like a conversion to uint64 does. ok is false for a float or a decimal beyond uint64
+func parseInteger64(text string) (num Number, ok bool) {
+	hex := len(text) > 1 && text[0] == '0' && (text[1] == 'x' || text[1] == 'X')
+	if hex || strings.ContainsAny(text, ".eE") {
+		num, ok = parseNumeral(text)
+		return num, ok && num.IsInteger
+	}
+	x, err := strconv.ParseUint(text, 10, 64)
+	if err != nil {
+		return Number{}, false
+	}
+	return Number{IsInteger: true, Int: int64(x)}, true
+}
 
-	// case [[ ]] - multiline string
-	if charM == '[' {
-		if !lex.matchOne("[") {
-			lex.reslice()
-			return Token{Type: LBRACE, Val: "[", atRow: lex.crrRow, atCol: lex.crrCol}, nil
+// numberSuffix consumes the LuaJIT suffix of a 64 bit integer (LL, ULL) or imaginary (i) number
+// and returns it in upper case, "" when there is none. Suffixes are case insensitive
+func (lex *Lexer) numberSuffix() (string, error) {
+	end := lex.i + 4
+	if end > len(lex.src) {
+		end = len(lex.src)
+	}
+	rest := strings.ToUpper(lex.src[lex.i:end])
+	suffix := ""
+	for _, s := range []string{"ULL", "LL", "I"} {
+		if strings.HasPrefix(rest, s) {
+			suffix = s
+			break
 		}
+	}
+	n := len(suffix)
+	if n == 0 || (len(rest) > n && isValidIdentifier(rest[n])) {
+		return "", nil
+	}
+	if !lex.dialect.HasNumberSuffixes() {
+		return "", &Error{Pos: lex.position(), Msg: fmt.Sprintf("number suffix '%s' is not supported by %s", lex.src[lex.i:lex.i+n], lex.dialect)}
+	}
+	for ; n > 0; n-- {
+		lex.next()
+	}
+	return suffix, nil
+}
 
-		crr, err := lex.current()
-		for err == nil && !(crr == ']' && crr == prev) {
-			prev = crr
+func (lex *Lexer) parseString() (Token, error) {
+	start := lex.position()
+	if crr, err := lex.current(); err == nil && crr == '[' {
+		level, ok := lex.openLongBracket()
+		if !ok {
+			if level > 0 {
+				return Token{Type: INVALID, Val: "["}, &Error{Pos: start, Msg: "invalid long string delimiter"}
+			}
 			lex.next()
-			crr, err = lex.current()
+			lex.reslice()
+			return Token{Type: LBRACE, Val: "["}, nil
 		}
+		str, err := lex.readLongBracket(level, start, "string")
 		if err != nil {
-			panic(err)
+			return Token{Type: INVALID, Val: lex.src}, err
 		}
-
-		str := lex.src[2 : lex.i-1]
-		lex.next()
 		lex.reslice()
+		return Token{Type: STRING, Val: str}, nil
+	}
 
-		return Token{Type: STRING, Val: str, atRow: lex.crrRow, atCol: lex.crrCol}, nil
+	if !lex.matchOne("\"'") {
+		return Token{Type: NUMBER, Val: ""}, errors.New("not a string")
 	}
+	charM := lex.src[lex.i-1]
 
-	lex.next()
+	var str strings.Builder
 	crr, err := lex.current()
-	for err == nil && crr != '\n' && (crr != charM || (crr == charM && prev == '\\')) {
-		prev = crr
-		lex.next()
+	for err == nil && crr != charM && !isNewline(crr) {
+		if crr == '\\' {
+			if err := lex.escape(&str); err != nil {
+				return Token{Type: INVALID, Val: lex.src[:lex.i]}, err
+			}
+		} else {
+			str.WriteByte(crr)
+			lex.next()
+		}
 		crr, err = lex.current()
 	}
 
-	if err != nil {
-		panic(err)
+	if err != nil || isNewline(crr) {
+		return Token{Type: INVALID, Val: lex.src[:lex.i]}, &Error{Pos: start, Msg: "unfinished string"}
 	}
-
-	if crr == '\n' {
-		return Token{Type: NUMBER, Val: "", atRow: lex.crrRow, atCol: lex.crrCol}, errors.New("Expected \" to end string")
-	}
-	str := lex.src[1:lex.i]
 	lex.next()
 	lex.reslice()
 
-	return Token{Type: STRING, Val: str, atRow: lex.crrRow, atCol: lex.crrCol}, nil
+	return Token{Type: STRING, Val: str.String()}, nil
 }
 
-func (lex *Lexer) parseComment() (Token, error) {
+// escape decodes the escape sequence starting with the '\\' at the current position into str
+func (lex *Lexer) escape(str *strings.Builder) error {
+	start := lex.position()
+	lex.next()
 	crr, err := lex.current()
 	if err != nil {
-		panic(err)
+		// the caller reports the unfinished string
+		return nil
+	}
+	if c, ok := simpleEscapes[crr]; ok {
+		str.WriteByte(c)
+		lex.next()
+		return nil
 	}
 
-	lex.next()
-	if crr == '-' && lex.matchOne("-") {
-		lex.reslice()
+	switch {
+	case crr == '\n' || crr == '\r':
+		// an escaped line break, \r\n and \n\r count as one
+		lex.next()
+		if next, err := lex.current(); err == nil && (next == '\n' || next == '\r') && next != crr {
+			lex.next()
+		}
+		str.WriteByte('\n')
+	case crr == 'z':
+		if !lex.dialect.HasZEscape() {
+			return &Error{Pos: start, Msg: fmt.Sprintf("escape '\\z' is not supported by %s", lex.dialect)}
+		}
+		// \z skips the following whitespace, line breaks included
+		lex.next()
 		crr, err = lex.current()
-		var comment string
+		for err == nil && isWhitespace(crr) {
+			lex.next()
+			crr, err = lex.current()
+		}
+	case crr == 'x':
+		if !lex.dialect.HasHexEscape() {
+			return &Error{Pos: start, Msg: fmt.Sprintf("escape '\\x' is not supported by %s", lex.dialect)}
+		}
 		lex.next()
-		if crr == '[' && lex.matchOne("[") {
-			lex.reslice()
+		var x uint32
+		for i := 0; i < 2; i++ {
 			crr, err = lex.current()
-			prev := crr
-			for err == nil && !(crr == ']' && prev == ']') {
-				lex.next()
-				prev = crr
-				crr, err = lex.current()
+			d, ok := hexValue(crr)
+			if err != nil || !ok {
+				return &Error{Pos: start, Msg: "hexadecimal digit expected"}
 			}
-
-			if err != nil {
-				comment = lex.src[:len(lex.src)]
-				lex.reslice()
-				if len(lex.src) == 0 {
-					return Token{Type: COMMENT, Val: comment, atRow: lex.crrRow, atCol: lex.crrCol}, nil
-				}
-				return Token{Type: COMMENT, Val: comment, atRow: lex.crrRow, atCol: lex.crrCol}, errors.New("EOF")
+			x = x<<4 + d
+			lex.next()
+		}
+		str.WriteByte(byte(x))
+	case crr == 'u':
+		if !lex.dialect.HasUTF8Escape() {
+			return &Error{Pos: start, Msg: fmt.Sprintf("escape '\\u' is not supported by %s", lex.dialect)}
+		}
+		lex.next()
+		if crr, err = lex.current(); err != nil || crr != '{' {
+			return &Error{Pos: start, Msg: "missing '{' in \\u{xxxx}"}
+		}
+		lex.next()
+		var x uint32
+		digits := 0
+		crr, err = lex.current()
+		for d, ok := hexValue(crr); err == nil && ok; d, ok = hexValue(crr) {
+			if x > 0x7FFFFFF {
+				return &Error{Pos: start, Msg: "UTF-8 value too large"}
 			}
-			comment = lex.src[:lex.i-1]
+			x = x<<4 + d
+			digits++
 			lex.next()
-			lex.reslice()
-			return Token{Type: COMMENT, Val: comment, atRow: lex.crrRow, atCol: lex.crrCol}, nil
+			crr, err = lex.current()
 		}
-
-		for err == nil && crr != '\n' {
+		if digits == 0 {
+			return &Error{Pos: start, Msg: "hexadecimal digit expected"}
+		}
+		if x > lex.dialect.MaxUTF8Escape() {
+			return &Error{Pos: start, Msg: "UTF-8 value too large"}
+		}
+		if err != nil || crr != '}' {
+			return &Error{Pos: start, Msg: "missing '}' in \\u{xxxx}"}
+		}
+		lex.next()
+		str.Write(utf8Escape(x))
+	case isDigit(crr):
+		// up to 3 decimal digits
+		x := 0
+		for i := 0; i < 3 && err == nil && isDigit(crr); i++ {
+			x = x*10 + int(crr-'0')
 			lex.next()
 			crr, err = lex.current()
 		}
+		if x > 255 {
+			return &Error{Pos: start, Msg: "decimal escape too large"}
+		}
+		str.WriteByte(byte(x))
+	default:
+		return &Error{Pos: start, Msg: fmt.Sprintf("invalid escape sequence '\\%c'", crr)}
+	}
+	return nil
+}
 
-		if err != nil {
-			comment = lex.src[:len(lex.src)]
-			lex.reslice()
-			if len(lex.src) == 0 {
-				return Token{Type: COMMENT, Val: comment, atRow: lex.crrRow, atCol: lex.crrCol}, nil
+// openLongBracket checks for an opening long bracket '[' '='* '[' at the current position
+// without consuming it. level is the number of '=', ok is false when the second '[' is missing
+func (lex *Lexer) openLongBracket() (level int, ok bool) {
+	rest := lex.src[lex.i:]
+	if len(rest) == 0 || rest[0] != '[' {
+		return 0, false
+	}
+	level = 1
+	for level < len(rest) && rest[level] == '=' {
+		level++
+	}
+	lex.hitEnd = lex.hitEnd || level == len(rest)
+	return level - 1, level < len(rest) && rest[level] == '['
+}
+
+// readLongBracket consumes a long bracket of the given level and returns its content.
+// A line break right after the opening bracket is not part of the content
+func (lex *Lexer) readLongBracket(level int, start Position, kind string) (string, error) {
+	for i := 0; i < level+2; i++ {
+		lex.next()
+	}
+	for _, newline := range []string{"\r\n", "\n\r", "\n", "\r"} {
+		if strings.HasPrefix(lex.src[lex.i:], newline) {
+			for range newline {
+				lex.next()
 			}
-			return Token{Type: COMMENT, Val: comment, atRow: lex.crrRow, atCol: lex.crrCol}, errors.New("EOF")
+			break
 		}
-		comment = lex.src[:lex.i]
+	}
+
+	closing := "]" + strings.Repeat("=", level) + "]"
+	end := strings.Index(lex.src[lex.i:], closing)
+	if end < 0 {
+		for lex.i < len(lex.src) {
+			lex.next()
+		}
+		return "", &Error{Pos: start, Msg: "unfinished long " + kind}
+	}
+	contentStart := lex.i
+	for i := 0; i < end+len(closing); i++ {
 		lex.next()
-		lex.reslice()
-		return Token{Type: COMMENT, Val: comment, atRow: lex.crrRow, atCol: lex.crrCol}, nil
 	}
+	return normalizeNewlines(lex.src[contentStart : contentStart+end]), nil
+}
 
-	lex.prev()
-	return Token{Type: INVALID, Val: "", atRow: lex.crrRow, atCol: lex.crrCol}, errors.New("not a comment")
+// normalizeNewlines turns each line break, \r\n, \n\r, \r or \n, into \n as Lua does in long brackets
+func normalizeNewlines(s string) string {
+	if !strings.ContainsRune(s, '\r') {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if !isNewline(s[i]) {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+1 < len(s) && isNewline(s[i+1]) && s[i+1] != s[i] {
+			i++
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
 }
 
-func (lex *Lexer) parseIdentifier() (Token, error) {
+func (lex *Lexer) parseComment() (Token, error) {
+	if !strings.HasPrefix(lex.src[lex.i:], "--") {
+		return Token{Type: INVALID, Val: ""}, errors.New("not a comment")
+	}
+	start := lex.position()
+	lex.next()
+	lex.next()
+	lex.reslice()
 
-	crr, err := lex.current()
-	if err != nil {
-		panic(err)
+	if level, ok := lex.openLongBracket(); ok {
+		comment, err := lex.readLongBracket(level, start, "comment")
+		if err != nil {
+			return Token{Type: COMMENT, Val: lex.src}, err
+		}
+		lex.reslice()
+		return Token{Type: COMMENT, Val: comment}, nil
 	}
 
-	if isValidStartIdentifier(crr) {
+	crr, err := lex.current()
+	for err == nil && !isNewline(crr) {
 		lex.next()
 		crr, err = lex.current()
-		for err == nil && isValidIdentifier(crr) {
+	}
+	comment := lex.src[:lex.i]
+	lex.reslice()
+	return Token{Type: COMMENT, Val: comment}, nil
+}
+
+const byteOrderMark = "\uFEFF"
+
+// parseShebang skips a byte order mark and a first line starting with '#' at the start of the source,
+// like the Lua loader does. Val is that line without the line break.
+// A byte order mark without such a line is whitespace
+func (lex *Lexer) parseShebang() (Token, error) {
+	if strings.HasPrefix(lex.src, byteOrderMark) {
+		for i := 0; i < len(byteOrderMark); i++ {
+			lex.next()
+		}
+	}
+	bom := lex.i
+	crr, err := lex.current()
+	if err == nil && crr == '#' {
+		for err == nil && !isNewline(crr) {
 			lex.next()
 			crr, err = lex.current()
 		}
+	}
+	line := lex.src[bom:lex.i]
+	lex.reslice()
+	if line == "" {
+		return Token{Type: WHITESPACE, Val: byteOrderMark}, nil
+	}
+	return Token{Type: SHEBANG, Val: line}, nil
+}
+
+func (lex *Lexer) parseIdentifier() (Token, error) {
+
+	if _, err := lex.current(); err != nil {
+		return Token{Type: INVALID, Val: ""}, err
+	}
+
+	if n := lex.identifierChar(true); n > 0 {
+		for ; n > 0; n = lex.identifierChar(false) {
+			for ; n > 0; n-- {
+				lex.next()
+			}
+		}
 		str := lex.src[:lex.i]
 		lex.reslice()
 		val, hasKey := lex.keywords[str]
 
 		// keyword case
 		if hasKey {
-			return Token{Type: val, Val: str, atRow: lex.crrRow, atCol: lex.crrCol}, nil
+			return Token{Type: val, Val: str}, nil
 		}
-		return Token{Type: IDENTIFIER, Val: str, atRow: lex.crrRow, atCol: lex.crrCol}, nil
+		return Token{Type: IDENTIFIER, Val: str}, nil
 	}
 
-	return Token{Type: INVALID, Val: "", atRow: lex.crrRow, atCol: lex.crrCol}, errors.New("not a identifier")
+	return Token{Type: INVALID, Val: ""}, errors.New("not a identifier")
+}
+
+// identifierChar returns the length of the identifier character at the current position, 0 if there is none.
+// Created WithUnicodeIdentifiers the lexer also takes Unicode letters, and digits and combining marks after the first one
+func (lex *Lexer) identifierChar(first bool) int {
+	crr, err := lex.current()
+	switch {
+	case err != nil:
+		return 0
+	case crr < utf8.RuneSelf:
+		if isValidStartIdentifier(crr) || !first && isDigit(crr) {
+			return 1
+		}
+		return 0
+	case !lex.unicodeIdents:
+		return 0
+	}
+	r, size := utf8.DecodeRuneInString(lex.src[lex.i:])
+	if unicode.IsLetter(r) || !first && (unicode.IsDigit(r) || unicode.In(r, unicode.Mn, unicode.Mc)) {
+		return size
+	}
+	return 0
+}
+
+// checkUTF8 reports the first byte of the source of a string or comment that is not valid UTF-8
+func (lex *Lexer) checkUTF8(token Token) error {
+	for i := 0; i < len(token.Raw); {
+		r, size := utf8.DecodeRuneInString(token.Raw[i:])
+		if r == utf8.RuneError && size == 1 {
+			// count the position up to the byte like the lexer does
+			scan := Lexer{src: token.Raw[:i], crrRow: token.Start.Line, crrCol: token.Start.Col, offset: token.Start.Offset, unit: lex.unit}
+			for scan.i < len(scan.src) {
+				scan.next()
+			}
+			kind := "string"
+			if token.Type == COMMENT {
+				kind = "comment"
+			}
+			return &Error{Pos: scan.position(), Msg: "invalid UTF-8 in " + kind}
+		}
+		i += size
+	}
+	return nil
+}
+
+// luauTokens are the tokens only Luau has, a token comes before the ones it starts with
+var luauTokens = []Token{
+	{Type: IDIVASSIGN, Val: "//="},
+	{Type: CONCATASSIGN, Val: "..="},
+	{Type: PLUSASSIGN, Val: "+="},
+	{Type: MINUSASSIGN, Val: "-="},
+	{Type: MULTASSIGN, Val: "*="},
+	{Type: DIVASSIGN, Val: "/="},
+	{Type: MODASSIGN, Val: "%="},
+	{Type: POWASSIGN, Val: "^="},
+	{Type: ARROW, Val: "->"},
+	{Type: QUESTION, Val: "?"},
+}
+
+// luauToken matches the compound assignments and the punctuation of Luau types.
+// '>>' is never a token in Luau so that nested type arguments can be closed
+func (lex *Lexer) luauToken() (Token, bool) {
+	for _, token := range luauTokens {
+		if strings.HasPrefix(lex.src[lex.i:], token.Val) {
+			for range token.Val {
+				lex.next()
+			}
+			lex.reslice()
+			return token, true
+		}
+	}
+	return Token{}, false
 }
 
 func (lex *Lexer) smallerToken() (Token, error) {
 	crr, err := lex.current()
 	if err != nil {
-		panic(err)
+		return Token{Type: INVALID, Val: ""}, err
 	}
 
-	var token = Token{Type: INVALID, Val: "", atRow: lex.crrRow, atCol: lex.crrCol}
-	err = nil
+	var token = Token{Type: INVALID, Val: ""}
 
 	switch crr {
 
 	case '+':
-		token = Token{Type: PLUS, Val: "+", atRow: lex.crrRow, atCol: lex.crrCol}
+		token = Token{Type: PLUS, Val: "+"}
 	case '-':
-		token = Token{Type: MINUS, Val: "-", atRow: lex.crrRow, atCol: lex.crrCol}
+		token = Token{Type: MINUS, Val: "-"}
 	case '*':
-		token = Token{Type: MULT, Val: "*", atRow: lex.crrRow, atCol: lex.crrCol}
+		token = Token{Type: MULT, Val: "*"}
 	case '/':
-		token = Token{Type: DIV, Val: "/", atRow: lex.crrRow, atCol: lex.crrCol}
+		lex.next()
+		crr, err = lex.current()
+		if err == nil && crr == '/' {
+			lex.next()
+			lex.reslice()
+			return Token{Type: IDIV, Val: "//"}, nil
+		}
+		lex.reslice()
+		return Token{Type: DIV, Val: "/"}, nil
 	case '%':
-		token = Token{Type: MOD, Val: "%", atRow: lex.crrRow, atCol: lex.crrCol}
+		token = Token{Type: MOD, Val: "%"}
 	case '^':
-		token = Token{Type: POW, Val: "^", atRow: lex.crrRow, atCol: lex.crrCol}
+		token = Token{Type: POW, Val: "^"}
 	case '#':
-		token = Token{Type: HTAG, Val: "#", atRow: lex.crrRow, atCol: lex.crrCol}
+		token = Token{Type: HTAG, Val: "#"}
+	case '&':
+		token = Token{Type: BAND, Val: "&"}
+	case '|':
+		token = Token{Type: BOR, Val: "|"}
+	case '~':
+		lex.next()
+		crr, err = lex.current()
+		if err == nil && crr == '=' {
+			lex.next()
+			lex.reslice()
+			return Token{Type: NOTEQ, Val: "~="}, nil
+		}
+		lex.reslice()
+		return Token{Type: BXOR, Val: "~"}, nil
 	case '(':
-		token = Token{Type: LPAR, Val: "(", atRow: lex.crrRow, atCol: lex.crrCol}
+		token = Token{Type: LPAR, Val: "("}
 	case ')':
-		token = Token{Type: RPAR, Val: ")", atRow: lex.crrRow, atCol: lex.crrCol}
+		token = Token{Type: RPAR, Val: ")"}
 	case '[':
-		token = Token{Type: LBRACE, Val: "[", atRow: lex.crrRow, atCol: lex.crrCol}
+		token = Token{Type: LBRACE, Val: "["}
 	case ']':
-		token = Token{Type: RBRACE, Val: "]", atRow: lex.crrRow, atCol: lex.crrCol}
+		token = Token{Type: RBRACE, Val: "]"}
 	case '{':
-		token = Token{Type: LCBRACE, Val: "{", atRow: lex.crrRow, atCol: lex.crrCol}
+		token = Token{Type: LCBRACE, Val: "{"}
 	case '}':
-		token = Token{Type: RCBRACE, Val: "}", atRow: lex.crrRow, atCol: lex.crrCol}
+		token = Token{Type: RCBRACE, Val: "}"}
 	case ';':
-		token = Token{Type: SEMICOLON, Val: ";", atRow: lex.crrRow, atCol: lex.crrCol}
+		token = Token{Type: SEMICOLON, Val: ";"}
 	case ':':
-		token = Token{Type: COLON, Val: ":", atRow: lex.crrRow, atCol: lex.crrCol}
+		lex.next()
+		crr, err = lex.current()
+		if err == nil && crr == ':' {
+			lex.next()
+			lex.reslice()
+			return Token{Type: DBCOLON, Val: "::"}, nil
+		}
+		lex.reslice()
+		return Token{Type: COLON, Val: ":"}, nil
 	case ',':
-		token = Token{Type: COMMA, Val: ",", atRow: lex.crrRow, atCol: lex.crrCol}
+		token = Token{Type: COMMA, Val: ","}
 	case '=':
 		lex.next()
 		crr, err = lex.current()
 		if err == nil && crr == '=' {
 			lex.next()
 			lex.reslice()
-			return Token{Type: EQ, Val: "==", atRow: lex.crrRow, atCol: lex.crrCol}, err
+			return Token{Type: EQ, Val: "=="}, nil
 		}
 		lex.reslice()
-		return Token{Type: ASSIGN, Val: "=", atRow: lex.crrRow, atCol: lex.crrCol}, err
+		return Token{Type: ASSIGN, Val: "="}, nil
 	case '<':
 		lex.next()
 		crr, err = lex.current()
 		if err == nil && crr == '=' {
 			lex.next()
 			lex.reslice()
-			return Token{Type: LESSERQ, Val: "<=", atRow: lex.crrRow, atCol: lex.crrCol}, err
+			return Token{Type: LESSERQ, Val: "<="}, nil
+		}
+		if err == nil && crr == '<' && !lex.dialect.HasTypes() {
+			lex.next()
+			lex.reslice()
+			return Token{Type: SHL, Val: "<<"}, nil
 		}
 		lex.reslice()
-		return Token{Type: LESSER, Val: "<", atRow: lex.crrRow, atCol: lex.crrCol}, err
+		return Token{Type: LESSER, Val: "<"}, nil
 	case '>':
 		lex.next()
 		crr, err = lex.current()
 		if err == nil && crr == '=' {
 			lex.next()
 			lex.reslice()
-			return Token{Type: GREATERQ, Val: ">=", atRow: lex.crrRow, atCol: lex.crrCol}, err
+			return Token{Type: GREATERQ, Val: ">="}, nil
+		}
+		if err == nil && crr == '>' && !lex.dialect.HasTypes() {
+			lex.next()
+			lex.reslice()
+			return Token{Type: SHR, Val: ">>"}, nil
 		}
 		lex.reslice()
-		return Token{Type: GREATER, Val: ">", atRow: lex.crrRow, atCol: lex.crrCol}, err
+		return Token{Type: GREATER, Val: ">"}, nil
 	case '.':
 		lex.next()
 		crr, err = lex.current()
@@ -374,13 +960,13 @@ func (lex *Lexer) smallerToken() (Token, error) {
 			if err == nil && crr == '.' {
 				lex.next()
 				lex.reslice()
-				return Token{Type: VARAGS, Val: "...", atRow: lex.crrRow, atCol: lex.crrCol}, err
+				return Token{Type: VARAGS, Val: "..."}, nil
 			}
 			lex.reslice()
-			return Token{Type: CONCAT, Val: "..", atRow: lex.crrRow, atCol: lex.crrCol}, err
+			return Token{Type: CONCAT, Val: ".."}, nil
 		}
 		lex.reslice()
-		return Token{Type: DOT, Val: ".", atRow: lex.crrRow, atCol: lex.crrCol}, err
+		return Token{Type: DOT, Val: "."}, nil
 	}
 
 	if token.Type == INVALID {
@@ -394,32 +980,96 @@ func (lex *Lexer) smallerToken() (Token, error) {
 
 func (lex *Lexer) nextToken() (Token, error) {
 
+	lex.fill(lookaheadBytes)
+	start := lex.position()
+	// a shebang is only the very first bytes of the source, not after whitespace
+	shebang := start.Offset == 0 && (strings.HasPrefix(lex.src, byteOrderMark) || strings.HasPrefix(lex.src, "#"))
 	char, err := lex.current()
-	for err == nil && len(lex.src) > 0 && isWhitespace(char) {
+	// whitespace kept as trivia is split before a line break, which ends the trailing trivia of a line
+	lineBreak := err == nil && isNewline(char)
+	for err == nil && len(lex.src) > 0 && isWhitespace(char) && (!lex.trivia || lineBreak || !isNewline(char)) {
 		lex.next()
+		lex.fill(lookaheadBytes)
 		char, err = lex.current()
 	}
+	if lex.trivia && lex.i > 0 {
+		space := lex.src[:lex.i]
+		if lex.reader != nil {
+			space = strings.Clone(space)
+		}
+		token := Token{Type: WHITESPACE, Val: space, Raw: space, Start: start, End: lex.position()}
+		lex.reslice()
+		return token, nil
+	}
 
 	if err := lex.reslice(); err != nil {
-		return Token{Type: EOF, Val: "", atRow: lex.crrRow, atCol: lex.crrCol}, err
+		return Token{Type: EOF, Val: "", Start: lex.position(), End: lex.position()}, nil
+	}
+
+	match := lex.matchToken
+	if shebang {
+		match = lex.parseShebang
+	}
+	token, err := lex.matchBuffered(match)
+	if err == nil && lex.validUTF8 && (token.Type == STRING || token.Type == COMMENT) {
+		err = lex.checkUTF8(token)
+	}
+	if err == nil && !lex.dialect.supports(token.Type) {
+		return token, &Error{Pos: token.Start, Msg: fmt.Sprintf("'%s' is not supported by %s", token.Val, lex.dialect)}
+	}
+	return token, err
+}
+
+// matchBuffered matches the token at the current position. A token that may go on past the
+// buffered source is matched again after reading more, with twice the buffer each time
+func (lex *Lexer) matchBuffered(match func() (Token, error)) (Token, error) {
+	for {
+		state := *lex
+		lex.hitEnd = false
+		src := lex.src
+		start := lex.position()
+		token, err := match()
+		if lex.reader != nil && (lex.hitEnd || lex.i+lookaheadBytes > len(lex.src)) {
+			*lex = state
+			lex.fill(2*len(lex.src) + chunkSize)
+			continue
+		}
+		token.Start = start
+		token.End = lex.position()
+		token.Raw = src[:token.End.Offset-start.Offset]
+		if state.reader != nil {
+			// do not keep the whole buffer alive through the token
+			token.Val = strings.Clone(token.Val)
+			token.Raw = strings.Clone(token.Raw)
+		}
+		return token, err
 	}
+}
 
+func (lex *Lexer) matchToken() (Token, error) {
 	token, err := lex.parseComment()
-	if err == nil || len(lex.src) == 0 {
-		return token, nil
+	if _, ok := err.(*Error); err == nil || ok {
+		return token, err
 	}
 
 	token, err = lex.parseString()
-	if err == nil {
-		return token, nil
+	if _, ok := err.(*Error); err == nil || ok {
+		return token, err
 	}
 
-	token, err = lex.smallerToken()
-	if err == nil {
-		return token, nil
+	// before smallerToken so that a leading dot starts a number
+	token, err = lex.parseNumber()
+	if _, ok := err.(*Error); err == nil || ok {
+		return token, err
 	}
 
-	token, err = lex.parseNumber()
+	if lex.dialect.HasTypes() {
+		if token, ok := lex.luauToken(); ok {
+			return token, nil
+		}
+	}
+
+	token, err = lex.smallerToken()
 	if err == nil {
 		return token, nil
 	}
@@ -429,19 +1079,27 @@ func (lex *Lexer) nextToken() (Token, error) {
 		return token, nil
 	}
 
-	return Token{Type: INVALID, Val: "", atRow: lex.crrRow, atCol: lex.crrCol}, nil
+	// unknown symbol, skip it and let the parser report it
+	lex.next()
+	token = Token{Type: INVALID, Val: lex.src[:lex.i]}
+	lex.reslice()
+	return token, nil
 }
 
-// Run produces a list of tokens from the source
+// Run produces a list of tokens from the source.
+// It stops at the first lexical error, which is returned as an *Error
 func (lex *Lexer) Run() ([]Token, error) {
-	for len(lex.src) > 0 {
-		token, err := lex.nextToken()
+	for {
+		token, err := lex.Next()
 		if err != nil {
 			return lex.tokens, err
 		}
-		if token.Type != COMMENT {
-			lex.tokens = append(lex.tokens, token)
+		if token.Type == EOF {
+			if lex.trivia {
+				lex.tokens = append(lex.tokens, token)
+			}
+			return lex.tokens, nil
 		}
+		lex.tokens = append(lex.tokens, token)
 	}
-	return lex.tokens, nil
 }
@@ -0,0 +1,125 @@
+package lexer
+
+import (
+	"io"
+)
+
+// chunkSize is how much of the source a streaming lexer reads at once
+const chunkSize = 64 * 1024
+
+// lookaheadBytes is the most a token is looked at past its end. A token ending closer
+// than that to the end of the buffered source is matched again with more of it
+const lookaheadBytes = 8
+
+// NewReader constructs a lexer reading the source from r as the tokens are requested with Next or Peek.
+// Only the source of the tokens not returned yet is kept in memory
+func (lex *Lexer) NewReader(r io.Reader, opts ...Option) Lexer {
+	l := lex.New("", opts...)
+	l.reader = r
+	return l
+}
+
+// fill reads from the reader until n bytes after the current position are buffered
+// or the source ends. A read error other than io.EOF ends the source and is kept in err
+func (lex *Lexer) fill(n int) {
+	if lex.reader == nil || lex.i+n <= len(lex.src) {
+		return
+	}
+	buf := make([]byte, chunkSize)
+	for lex.reader != nil && lex.i+n > len(lex.src) {
+		m, err := lex.reader.Read(buf)
+		// the consumed part of the old buffer is dropped here
+		lex.src += string(buf[:m])
+		if err != nil {
+			if err != io.EOF {
+				lex.err = err
+			}
+			lex.reader = nil
+		}
+	}
+}
+
+// Next returns the next token, comments are skipped. At the end of the source it returns an EOF token.
+// After a lexical error it keeps returning the error
+func (lex *Lexer) Next() (Token, error) {
+	if len(lex.lookahead) > 0 {
+		token := lex.lookahead[0]
+		lex.lookahead = lex.lookahead[1:]
+		return token, nil
+	}
+	return lex.scan()
+}
+
+// Peek returns the token n places after the one Next returns next, Peek(0) being that one
+func (lex *Lexer) Peek(n int) (Token, error) {
+	for len(lex.lookahead) <= n {
+		token, err := lex.scan()
+		if err != nil {
+			return token, err
+		}
+		lex.lookahead = append(lex.lookahead, token)
+	}
+	return lex.lookahead[n], nil
+}
+
+func (lex *Lexer) scan() (Token, error) {
+	for {
+		if lex.err != nil {
+			pos := lex.position()
+			return Token{Type: EOF, Start: pos, End: pos}, lex.err
+		}
+		token, err := lex.rawToken()
+		if err != nil {
+			lex.err = err
+			return token, err
+		}
+		if token.Type == COMMENT || token.Type == WHITESPACE {
+			if lex.trivia {
+				lex.leading = append(lex.leading, token)
+			}
+			continue
+		}
+		if lex.trivia {
+			token.Trivia = &Trivia{Leading: lex.leading}
+			lex.leading = nil
+			if token.Type != EOF {
+				token.Trivia.Trailing = lex.trailing()
+			}
+		}
+		return token, nil
+	}
+}
+
+// rawToken returns the next token including trivia
+func (lex *Lexer) rawToken() (Token, error) {
+	if lex.held != nil {
+		token := *lex.held
+		lex.held = nil
+		return token, nil
+	}
+	return lex.nextToken()
+}
+
+// trailing lexes the trivia after a token up to the end of its line. What it reads past
+// that is kept for the next token
+func (lex *Lexer) trailing() []Token {
+	var trailing []Token
+	for {
+		token, err := lex.rawToken()
+		if err != nil {
+			// reported by the next scan
+			lex.err = err
+			return trailing
+		}
+		switch {
+		case token.Type == COMMENT || token.Type == WHITESPACE && !isNewline(token.Val[0]):
+			trailing = append(trailing, token)
+		case token.Type == WHITESPACE:
+			lex.leading = append(lex.leading, token)
+			return trailing
+		default:
+			lex.held = &token
+			return trailing
+		}
+	}
+}
@@ -23,11 +23,14 @@ const (
 	IF
 	UNTIL
 	WHILE
+	GOTO
 
 	IDENTIFIER
 	STRING
 	NUMBER
 	COMMENT
+	WHITESPACE
+	SHEBANG
 	EOF
 	INVALID
 
@@ -35,6 +38,7 @@ const (
 	COMMA
 	SEMICOLON
 	COLON
+	DBCOLON // ::
 	LPAR
 	RPAR
 	LBRACE  // [
@@ -57,11 +61,116 @@ const (
 	GREATER  // >
 	GREATERQ // >=
 	EQ       // ==
+	NOTEQ    // ~=
 	AND
 	OR
+	IDIV // //
+	BAND // &
+	BOR  // |
+	BXOR // ~
+	SHL  // <<
+	SHR  // >>
 
 	//unary op's
 	UMINUS
 	NOT
 	HTAG // #
+	BNOT // ~
+
+	// luau
+	PLUSASSIGN   // +=
+	MINUSASSIGN  // -=
+	MULTASSIGN   // *=
+	DIVASSIGN    // /=
+	IDIVASSIGN   // //=
+	MODASSIGN    // %=
+	POWASSIGN    // ^=
+	CONCATASSIGN // ..=
+	ARROW        // ->
+	QUESTION     // ?
 )
+
+var tokenNames = map[TokenType]string{
+	END:          "end",
+	IN:           "in",
+	REPEAT:       "repeat",
+	BREAK:        "break",
+	FALSE:        "false",
+	LOCAL:        "local",
+	RETURN:       "return",
+	DO:           "do",
+	FOR:          "for",
+	NIL:          "nil",
+	THEN:         "then",
+	ELSE:         "else",
+	FUNCTION:     "function",
+	TRUE:         "true",
+	ELSEIF:       "elseif",
+	IF:           "if",
+	UNTIL:        "until",
+	WHILE:        "while",
+	GOTO:         "goto",
+	IDENTIFIER:   "<name>",
+	STRING:       "<string>",
+	NUMBER:       "<number>",
+	COMMENT:      "<comment>",
+	WHITESPACE:   "<whitespace>",
+	SHEBANG:      "<shebang>",
+	EOF:          "<eof>",
+	INVALID:      "<invalid>",
+	DOT:          ".",
+	COMMA:        ",",
+	SEMICOLON:    ";",
+	COLON:        ":",
+	DBCOLON:      "::",
+	LPAR:         "(",
+	RPAR:         ")",
+	LBRACE:       "[",
+	RBRACE:       "]",
+	LCBRACE:      "{",
+	RCBRACE:      "}",
+	VARAGS:       "...",
+	ASSIGN:       "=",
+	PLUS:         "+",
+	MINUS:        "-",
+	MULT:         "*",
+	DIV:          "/",
+	POW:          "^",
+	MOD:          "%",
+	CONCAT:       "..",
+	LESSER:       "<",
+	LESSERQ:      "<=",
+	GREATER:      ">",
+	GREATERQ:     ">=",
+	EQ:           "==",
+	NOTEQ:        "~=",
+	AND:          "and",
+	OR:           "or",
+	IDIV:         "//",
+	BAND:         "&",
+	BOR:          "|",
+	BXOR:         "~",
+	SHL:          "<<",
+	SHR:          ">>",
+	UMINUS:       "-",
+	NOT:          "not",
+	HTAG:         "#",
+	BNOT:         "~",
+	PLUSASSIGN:   "+=",
+	MINUSASSIGN:  "-=",
+	MULTASSIGN:   "*=",
+	DIVASSIGN:    "/=",
+	IDIVASSIGN:   "//=",
+	MODASSIGN:    "%=",
+	POWASSIGN:    "^=",
+	CONCATASSIGN: "..=",
+	ARROW:        "->",
+	QUESTION:     "?"}
+
+// String returns the token as it appears in the source, or a placeholder like <name> for tokens without fixed text
+func (tt TokenType) String() string {
+	if name, ok := tokenNames[tt]; ok {
+		return name
+	}
+	return "<unknown>"
+}
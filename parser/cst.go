@@ -0,0 +1,249 @@
+package parser
+
+import (
+	"io"
+	"sort"
+	"strings"
+
+	"../lexer"
+)
+
+// CST is a node of the lossless concrete syntax tree. It groups the tokens an AST node was parsed from,
+// Children holds them in source order together with the CST nodes of the sub-nodes.
+// A sub-node with the zero Span, like the implicit 'self' of a method, is left out and so is one
+// whose span does not nest in the tree, its tokens belong to the enclosing node
+type CST struct {
+	Node     Node
+	Children []CSTChild
+
+	// the options the tree was parsed with, AST parses with them again
+	opts []Option
+}
+
+// CSTChild is a token or, when Node is not nil, a nested CST node
+type CSTChild struct {
+	Token lexer.Token
+	Node  *CST
+}
+
+// ParseCST parses the tokens into a CST. The tokens should come from a lexer created WithTrivia,
+// whose EOF token ends the tree with the trivia at the end of the source.
+// The tree holds every token even when the parse fails
+func ParseCST(tokens []lexer.Token, opts ...Option) (*CST, []error) {
+	p := NewParser(tokens, opts...)
+	program, errs := p.Run()
+	return NewCST(program, tokens, opts...), errs
+}
+
+// NewCST builds the CST of a program from all the tokens it was parsed from with opts
+func NewCST(program Program, tokens []lexer.Token, opts ...Option) *CST {
+	b := &cstBuilder{tokens: tokens}
+	program.AcceptVisitor(b)
+	b.root.opts = opts
+	return b.root
+}
+
+// cstBuilder is a Visitor building the CST of the nodes it visits. A node takes the tokens
+// up to the end of its span, the ones before a sub-node go before the CST node of the sub-node
+type cstBuilder struct {
+	tokens []lexer.Token
+	parent *CST
+	root   *CST
+	// the siblings nested in the span of the node being visited, like the types of its parameters
+	adopted []Node
+}
+
+func (b *cstBuilder) node(n Node, children ...Node) {
+	c := &CST{Node: n}
+	parent := b.parent
+	b.parent = c
+
+	var nested []Node
+	for _, child := range append(children, b.adopted...) {
+		if child != nil && child.NodeSpan().Start.Line > 0 {
+			nested = append(nested, child)
+		}
+	}
+	b.adopted = nil
+	sort.SliceStable(nested, func(i, j int) bool {
+		return nested[i].NodeSpan().Start.Offset < nested[j].NodeSpan().Start.Offset
+	})
+	for i := 0; i < len(nested); i++ {
+		span := nested[i].NodeSpan()
+		if len(b.tokens) == 0 || span.Start.Offset < b.tokens[0].Start.Offset {
+			continue
+		}
+		for len(b.tokens) > 0 && b.tokens[0].Start.Offset < span.Start.Offset {
+			b.take()
+		}
+		child := nested[i]
+		for i+1 < len(nested) && nested[i+1].NodeSpan().End.Offset <= span.End.Offset {
+			b.adopted = append(b.adopted, nested[i+1])
+			i++
+		}
+		child.AcceptVisitor(b)
+	}
+
+	// the program takes the rest, the EOF token and its trivia included
+	end := n.NodeSpan().End.Offset
+	for len(b.tokens) > 0 && (parent == nil || b.tokens[0].End.Offset <= end) {
+		b.take()
+	}
+	b.parent = parent
+	if parent == nil {
+		b.root = c
+	} else {
+		parent.Children = append(parent.Children, CSTChild{Node: c})
+	}
+}
+
+func (b *cstBuilder) take() {
+	b.parent.Children = append(b.parent.Children, CSTChild{Token: b.tokens[0]})
+	b.tokens = b.tokens[1:]
+}
+
+// identifier keeps a missing identifier a nil Node
+func identifier(id *Identifier) Node {
+	if id == nil {
+		return nil
+	}
+	return id
+}
+
+func (s TypeSignature) nodes() []Node {
+	return join(s.TypeParams, s.ParamTypes, s.ReturnTypes)
+}
+
+func join(lists ...[]Node) []Node {
+	var nodes []Node
+	for _, list := range lists {
+		nodes = append(nodes, list...)
+	}
+	return nodes
+}
+
+func (b *cstBuilder) VisitSimpleExpr(e *SimpleExpr)       { b.node(e) }
+func (b *cstBuilder) VisitNumberLiteral(e *NumberLiteral) { b.node(e) }
+func (b *cstBuilder) VisitUnaryExpr(e *UnaryExpr)         { b.node(e, e.Operand) }
+func (b *cstBuilder) VisitBinExpr(e *BinExpr)             { b.node(e, e.Left, e.Right) }
+func (b *cstBuilder) VisitParenExpr(e *ParenExpr)         { b.node(e, e.Expr) }
+func (b *cstBuilder) VisitIdentifier(e *Identifier)       { b.node(e) }
+func (b *cstBuilder) VisitConstructorExpr(e *ConstructorExpr) {
+	b.node(e, e.FieldList...)
+}
+func (b *cstBuilder) VisitIndexExpr(e *IndexExpr)   { b.node(e, e.Base, e.ExprIndex) }
+func (b *cstBuilder) VisitMemberExpr(e *MemberExpr) { b.node(e, e.Obj, identifier(e.Field)) }
+func (b *cstBuilder) VisitKeyExpr(e *KeyExpr)       { b.node(e, e.LeftExpr, e.RightExpr) }
+func (b *cstBuilder) VisitProgram(p Program)        { b.node(p, p...) }
+func (b *cstBuilder) VisitArgList(l *ArgList)       { b.node(l, l.Args...) }
+func (b *cstBuilder) VisitReturnList(l *ReturnList) { b.node(l, l.Exprs...) }
+func (b *cstBuilder) VisitCallExpr(e *CallExpr)     { b.node(e, e.Base, e.Arguments) }
+func (b *cstBuilder) VisitMethodCallExpr(e *MethodCallExpr) {
+	b.node(e, e.Receiver, identifier(e.Method), e.Arguments)
+}
+func (b *cstBuilder) VisitFunction(f *Function) {
+	b.node(f, join([]Node{f.Parameters}, f.TypeSignature.nodes(), f.Body)...)
+}
+func (b *cstBuilder) VisitNamedFunction(f *NamedFunction) {
+	b.node(f, join([]Node{f.FunctionName, f.Parameters}, f.TypeSignature.nodes(), f.Body)...)
+}
+func (b *cstBuilder) VisitLocalFunction(f *LocalFunction) { b.node(f, f.NamedFunction) }
+func (b *cstBuilder) VisitAssignmentExpr(e *AssignmentExpr) {
+	b.node(e, join(e.Vars, e.Exprs)...)
+}
+func (b *cstBuilder) VisitLocalAssignmentExpr(e *LocalAssignmentExpr) {
+	b.node(e, join([]Node{e.AssignmentExpr}, e.Types)...)
+}
+func (b *cstBuilder) VisitDoStmnt(s *DoStmnt)       { b.node(s, s.Block...) }
+func (b *cstBuilder) VisitWhileStmnt(s *WhileStmnt) { b.node(s, join([]Node{s.Condition}, s.Block)...) }
+func (b *cstBuilder) VisitRepeatStmnt(s *RepeatStmnt) {
+	b.node(s, join(s.Block, []Node{s.Condition})...)
+}
+func (b *cstBuilder) VisitIfStmnt(s *IfStmnt)   { b.node(s, s.Clauses) }
+func (b *cstBuilder) VisitIfClause(s *IfClause) { b.node(s, join([]Node{s.Condition}, s.Block)...) }
+func (b *cstBuilder) VisitElseIfClause(s *ElseIfClause) {
+	b.node(s, join([]Node{s.Condition}, s.Block)...)
+}
+func (b *cstBuilder) VisitElseClause(s *ElseClause) { b.node(s, s.Block...) }
+func (b *cstBuilder) VisitNumericForStmnt(s *NumericForStmnt) {
+	b.node(s, join([]Node{identifier(s.Var), s.Init, s.Limit, s.Step}, s.Block)...)
+}
+func (b *cstBuilder) VisitForInStmnt(s *ForInStmnt) { b.node(s, join(s.Names, s.Exprs, s.Block)...) }
+func (b *cstBuilder) VisitGotoStmnt(s *GotoStmnt)   { b.node(s, identifier(s.Label)) }
+func (b *cstBuilder) VisitLabelStmnt(s *LabelStmnt) { b.node(s, identifier(s.Name)) }
+func (b *cstBuilder) VisitContinueStmnt(s *ContinueStmnt) {
+	b.node(s)
+}
+func (b *cstBuilder) VisitCompoundAssignment(e *CompoundAssignment) { b.node(e, e.Var, e.Expr) }
+func (b *cstBuilder) VisitTypeDecl(s *TypeDecl) {
+	b.node(s, join([]Node{identifier(s.Name)}, s.TypeParams, []Node{s.Type})...)
+}
+func (b *cstBuilder) VisitIfExpr(e *IfExpr)               { b.node(e, e.Condition, e.Then, e.Else) }
+func (b *cstBuilder) VisitTypeAssertion(e *TypeAssertion) { b.node(e, e.Expr, e.Type) }
+func (b *cstBuilder) VisitNamedType(t *NamedType) {
+	b.node(t, join([]Node{identifier(t.Module), identifier(t.Name)}, t.Args)...)
+}
+func (b *cstBuilder) VisitOptionalType(t *OptionalType)         { b.node(t, t.Type) }
+func (b *cstBuilder) VisitUnionType(t *UnionType)               { b.node(t, t.Types...) }
+func (b *cstBuilder) VisitIntersectionType(t *IntersectionType) { b.node(t, t.Types...) }
+func (b *cstBuilder) VisitTableType(t *TableType)               { b.node(t, t.Fields...) }
+func (b *cstBuilder) VisitTypeField(t *TypeField) {
+	b.node(t, identifier(t.Name), t.Key, t.Value)
+}
+func (b *cstBuilder) VisitFunctionType(t *FunctionType) {
+	b.node(t, join(t.TypeParams, t.Params, t.Returns)...)
+}
+func (b *cstBuilder) VisitTypeofType(t *TypeofType)     { b.node(t, t.Expr) }
+func (b *cstBuilder) VisitVariadicType(t *VariadicType) { b.node(t, t.Type) }
+func (b *cstBuilder) VisitErrorNode(e *ErrorNode)       { b.node(e) }
+
+// Tokens returns the tokens of the tree in source order
+func (c *CST) Tokens() []lexer.Token {
+	var tokens []lexer.Token
+	for _, child := range c.Children {
+		if child.Node != nil {
+			tokens = append(tokens, child.Node.Tokens()...)
+		} else {
+			tokens = append(tokens, child.Token)
+		}
+	}
+	return tokens
+}
+
+// Print writes the source of the tree, the original source byte for byte unless the tree was edited
+func (c *CST) Print(w io.Writer) error {
+	for _, token := range c.Tokens() {
+		if token.Trivia != nil {
+			for _, trivia := range token.Trivia.Leading {
+				if _, err := io.WriteString(w, trivia.Raw); err != nil {
+					return err
+				}
+			}
+		}
+		if _, err := io.WriteString(w, token.Raw); err != nil {
+			return err
+		}
+		if token.Trivia != nil {
+			for _, trivia := range token.Trivia.Trailing {
+				if _, err := io.WriteString(w, trivia.Raw); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (c *CST) String() string {
+	var b strings.Builder
+	c.Print(&b)
+	return b.String()
+}
+
+// AST parses the tokens of the tree again with the options the tree was parsed with and returns
+// a new AST, so it follows any edit of the tokens and leaves the nodes held by the tree untouched.
+// An edited token must keep its Type, Val, Raw and Num consistent
+func (c *CST) AST() (Program, []error) {
+	p := NewParser(c.Tokens(), c.opts...)
+	return p.Run()
+}
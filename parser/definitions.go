@@ -8,17 +8,20 @@ import (
 type Visitor interface {
 	// to do add visit methods
 	VisitSimpleExpr(*SimpleExpr)
+	VisitNumberLiteral(*NumberLiteral)
 	VisitUnaryExpr(*UnaryExpr)
 	VisitBinExpr(*BinExpr)
+	VisitParenExpr(*ParenExpr)
 	VisitIdentifier(*Identifier)
 	VisitConstructorExpr(*ConstructorExpr)
 	VisitIndexExpr(*IndexExpr)
 	VisitMemberExpr(*MemberExpr)
 	VisitKeyExpr(*KeyExpr)
 	VisitProgram(Program)
-	VisitArgList(ArgList)
-	VisitReturnList(ReturnList)
+	VisitArgList(*ArgList)
+	VisitReturnList(*ReturnList)
 	VisitCallExpr(*CallExpr)
+	VisitMethodCallExpr(*MethodCallExpr)
 	VisitFunction(*Function)
 	VisitNamedFunction(*NamedFunction)
 	VisitLocalFunction(*LocalFunction)
@@ -31,26 +34,105 @@ type Visitor interface {
 	VisitIfClause(*IfClause)
 	VisitElseIfClause(*ElseIfClause)
 	VisitElseClause(*ElseClause)
-	VisitForStmnt(*ForStmnt)
+	VisitNumericForStmnt(*NumericForStmnt)
+	VisitForInStmnt(*ForInStmnt)
+	VisitGotoStmnt(*GotoStmnt)
+	VisitLabelStmnt(*LabelStmnt)
+	VisitContinueStmnt(*ContinueStmnt)
+	VisitCompoundAssignment(*CompoundAssignment)
+	VisitTypeDecl(*TypeDecl)
+	VisitIfExpr(*IfExpr)
+	VisitTypeAssertion(*TypeAssertion)
+	VisitNamedType(*NamedType)
+	VisitOptionalType(*OptionalType)
+	VisitUnionType(*UnionType)
+	VisitIntersectionType(*IntersectionType)
+	VisitTableType(*TableType)
+	VisitTypeField(*TypeField)
+	VisitFunctionType(*FunctionType)
+	VisitTypeofType(*TypeofType)
+	VisitVariadicType(*VariadicType)
+	VisitErrorNode(*ErrorNode)
 }
 
 // Node is the interface type in the AST
 type Node interface {
 	AcceptVisitor(Visitor)
+	NodeSpan() Span
+}
+
+// Span is the range of source a node was parsed from, the zero Span for a node that is not in the source.
+// When the tokens have trivia
+// statements and table fields get the comments around them, and the comments inside a node
+// go to the innermost statement, field, expression, argument list, function or if clause holding them
+type Span struct {
+	Start    lexer.Position
+	End      lexer.Position
+	Comments *Comments
+}
+
+// Comments are the COMMENT tokens on the lines before a node, between its tokens
+// and after it on its last line. The comments at the end of the source trail the last statement
+type Comments struct {
+	Leading  []lexer.Token
+	Inner    []lexer.Token
+	Trailing []lexer.Token
+}
+
+// NodeSpan returns the span, every node embedding a Span gets it for free
+func (s Span) NodeSpan() Span {
+	return s
+}
+
+func (s *Span) addComments(c Comments) {
+	if s.Comments == nil {
+		s.Comments = &Comments{}
+	}
+	s.Comments.Leading = append(s.Comments.Leading, c.Leading...)
+	s.Comments.Inner = append(s.Comments.Inner, c.Inner...)
+	s.Comments.Trailing = append(s.Comments.Trailing, c.Trailing...)
+}
+
+func spanOf(n Node) Span {
+	if n == nil {
+		return Span{}
+	}
+	return n.NodeSpan()
+}
+
+func listSpan(nodes []Node) Span {
+	if len(nodes) == 0 {
+		return Span{}
+	}
+	return Span{Start: spanOf(nodes[0]).Start, End: spanOf(nodes[len(nodes)-1]).End}
 }
 
 // SimpleExpr ..
 type SimpleExpr struct {
+	Span
 	Type lexer.TokenType
 	Val  string
+	Raw  string // the source text, Val holds the decoded value of a string
 }
 
 func (se *SimpleExpr) AcceptVisitor(v Visitor) {
 	v.VisitSimpleExpr(se)
 }
 
+// NumberLiteral is a numeral with its source text and value
+type NumberLiteral struct {
+	Span
+	Raw string
+	lexer.Number
+}
+
+func (nl *NumberLiteral) AcceptVisitor(v Visitor) {
+	v.VisitNumberLiteral(nl)
+}
+
 // UnaryExpr ..
 type UnaryExpr struct {
+	Span
 	Op      lexer.TokenType
 	Operand Node
 }
@@ -61,6 +143,7 @@ func (ue *UnaryExpr) AcceptVisitor(v Visitor) {
 
 // BinExpr ..
 type BinExpr struct {
+	Span
 	Op    lexer.TokenType
 	Left  Node
 	Right Node
@@ -70,8 +153,20 @@ func (be *BinExpr) AcceptVisitor(v Visitor) {
 	v.VisitBinExpr(be)
 }
 
+// ParenExpr is '(' Expr ')'. The parentheses truncate a call or '...' to one value
+// and make the expression neither a variable nor a call statement
+type ParenExpr struct {
+	Span
+	Expr Node
+}
+
+func (pe *ParenExpr) AcceptVisitor(v Visitor) {
+	v.VisitParenExpr(pe)
+}
+
 // Identifier ..
 type Identifier struct {
+	Span
 	Name string
 }
 
@@ -80,6 +175,7 @@ func (id *Identifier) AcceptVisitor(v Visitor) {
 }
 
 type ConstructorExpr struct {
+	Span
 	FieldList []Node
 }
 
@@ -88,6 +184,7 @@ func (c *ConstructorExpr) AcceptVisitor(v Visitor) {
 }
 
 type IndexExpr struct {
+	Span
 	Base      Node
 	ExprIndex Node
 }
@@ -97,6 +194,7 @@ func (ie *IndexExpr) AcceptVisitor(v Visitor) {
 }
 
 type MemberExpr struct {
+	Span
 	Obj   Node
 	Field *Identifier
 }
@@ -106,6 +204,7 @@ func (m *MemberExpr) AcceptVisitor(v Visitor) {
 }
 
 type KeyExpr struct {
+	Span
 	LeftExpr  Node
 	RightExpr Node
 }
@@ -120,19 +219,33 @@ func (p Program) AcceptVisitor(v Visitor) {
 	v.VisitProgram(p)
 }
 
-type ArgList []Node
+func (p Program) NodeSpan() Span {
+	return listSpan(p)
+}
 
-func (l ArgList) AcceptVisitor(v Visitor) {
+// ArgList is the arguments of a call in parentheses or the parameters of a function,
+// its span covers the parentheses. The clauses of an IfStmnt are an ArgList too
+type ArgList struct {
+	Span
+	Args []Node
+}
+
+func (l *ArgList) AcceptVisitor(v Visitor) {
 	v.VisitArgList(l)
 }
 
-type ReturnList []Node
+// ReturnList is 'return' Exprs
+type ReturnList struct {
+	Span
+	Exprs []Node
+}
 
-func (l ReturnList) AcceptVisitor(v Visitor) {
+func (l *ReturnList) AcceptVisitor(v Visitor) {
 	v.VisitReturnList(l)
 }
 
 type CallExpr struct {
+	Span
 	Base      Node
 	Arguments Node
 }
@@ -141,19 +254,46 @@ func (e *CallExpr) AcceptVisitor(v Visitor) {
 	v.VisitCallExpr(e)
 }
 
+// MethodCallExpr is Receiver ':' Method Arguments
+type MethodCallExpr struct {
+	Span
+	Receiver  Node
+	Method    *Identifier
+	Arguments Node
+}
+
+func (e *MethodCallExpr) AcceptVisitor(v Visitor) {
+	v.VisitMethodCallExpr(e)
+}
+
 type Function struct {
-	Parameters ArgList
+	Span
+	Parameters *ArgList
 	Body       []Node
+	TypeSignature
+}
+
+// TypeSignature holds the Luau annotations of a function. ParamTypes follows the order
+// of the parameters with nil for the ones without a type, it is empty when none has one
+type TypeSignature struct {
+	TypeParams  []Node
+	ParamTypes  []Node
+	ReturnTypes []Node
 }
 
 func (f *Function) AcceptVisitor(v Visitor) {
 	v.VisitFunction(f)
 }
 
+// NamedFunction is a function statement. For methods defined with ':'
+// IsMethod is set and the implicit 'self' is the first of the Parameters
 type NamedFunction struct {
+	Span
 	FunctionName Node
-	Parameters   ArgList
+	Parameters   *ArgList
 	Body         []Node
+	IsMethod     bool
+	TypeSignature
 }
 
 func (f *NamedFunction) AcceptVisitor(v Visitor) {
@@ -161,6 +301,7 @@ func (f *NamedFunction) AcceptVisitor(v Visitor) {
 }
 
 type LocalFunction struct {
+	Span
 	*NamedFunction
 }
 
@@ -169,6 +310,7 @@ func (f *LocalFunction) AcceptVisitor(v Visitor) {
 }
 
 type AssignmentExpr struct {
+	Span
 	Vars  []Node
 	Exprs []Node
 }
@@ -177,8 +319,14 @@ func (e *AssignmentExpr) AcceptVisitor(v Visitor) {
 	v.VisitAssignmentExpr(e)
 }
 
+// LocalAssignmentExpr is a local declaration. Attribs holds the attribute
+// of each of the Vars, "const", "close" or "" when there is none.
+// In Luau Types holds the annotation of each of the Vars or nil
 type LocalAssignmentExpr struct {
+	Span
 	*AssignmentExpr
+	Attribs []string
+	Types   []Node
 }
 
 func (e *LocalAssignmentExpr) AcceptVisitor(v Visitor) {
@@ -186,6 +334,7 @@ func (e *LocalAssignmentExpr) AcceptVisitor(v Visitor) {
 }
 
 type DoStmnt struct {
+	Span
 	Block []Node
 }
 
@@ -194,6 +343,7 @@ func (s *DoStmnt) AcceptVisitor(v Visitor) {
 }
 
 type WhileStmnt struct {
+	Span
 	Condition Node
 	Block     []Node
 }
@@ -203,6 +353,7 @@ func (s *WhileStmnt) AcceptVisitor(v Visitor) {
 }
 
 type RepeatStmnt struct {
+	Span
 	Condition Node
 	Block     []Node
 }
@@ -212,6 +363,7 @@ func (s *RepeatStmnt) AcceptVisitor(v Visitor) {
 }
 
 type IfStmnt struct {
+	Span
 	Clauses Node
 }
 
@@ -220,6 +372,7 @@ func (s *IfStmnt) AcceptVisitor(v Visitor) {
 }
 
 type IfClause struct {
+	Span
 	Condition Node
 	Block     []Node
 }
@@ -229,6 +382,7 @@ func (s *IfClause) AcceptVisitor(v Visitor) {
 }
 
 type ElseIfClause struct {
+	Span
 	Condition Node
 	Block     []Node
 }
@@ -238,6 +392,7 @@ func (s *ElseIfClause) AcceptVisitor(v Visitor) {
 }
 
 type ElseClause struct {
+	Span
 	Block []Node
 }
 
@@ -245,13 +400,213 @@ func (s *ElseClause) AcceptVisitor(v Visitor) {
 	v.VisitElseClause(s)
 }
 
-type ForStmnt struct {
-	Start     Node
+// NumericForStmnt is 'for' Var '=' Init ',' Limit [',' Step] 'do' Block 'end'
+type NumericForStmnt struct {
+	Span
+	Var   *Identifier
+	Init  Node
+	Limit Node
+	Step  Node
+	Block []Node
+}
+
+func (s *NumericForStmnt) AcceptVisitor(v Visitor) {
+	v.VisitNumericForStmnt(s)
+}
+
+// ForInStmnt is 'for' Names 'in' Exprs 'do' Block 'end'
+type ForInStmnt struct {
+	Span
+	Names []Node
+	Exprs []Node
+	Block []Node
+}
+
+func (s *ForInStmnt) AcceptVisitor(v Visitor) {
+	v.VisitForInStmnt(s)
+}
+
+// GotoStmnt is 'goto' Label
+type GotoStmnt struct {
+	Span
+	Label *Identifier
+}
+
+func (s *GotoStmnt) AcceptVisitor(v Visitor) {
+	v.VisitGotoStmnt(s)
+}
+
+// LabelStmnt is '::' Name '::'
+type LabelStmnt struct {
+	Span
+	Name *Identifier
+}
+
+func (s *LabelStmnt) AcceptVisitor(v Visitor) {
+	v.VisitLabelStmnt(s)
+}
+
+// ContinueStmnt is the Luau 'continue'
+type ContinueStmnt struct {
+	Span
+}
+
+func (s *ContinueStmnt) AcceptVisitor(v Visitor) {
+	v.VisitContinueStmnt(s)
+}
+
+// CompoundAssignment is the Luau Var op'=' Expr, Op is the binary operator e.g. PLUS for '+='
+type CompoundAssignment struct {
+	Span
+	Op   lexer.TokenType
+	Var  Node
+	Expr Node
+}
+
+func (e *CompoundAssignment) AcceptVisitor(v Visitor) {
+	v.VisitCompoundAssignment(e)
+}
+
+// TypeDecl is ['export'] 'type' Name ['<' TypeParams '>'] '=' Type
+type TypeDecl struct {
+	Span
+	Export     bool
+	Name       *Identifier
+	TypeParams []Node
+	Type       Node
+}
+
+func (s *TypeDecl) AcceptVisitor(v Visitor) {
+	v.VisitTypeDecl(s)
+}
+
+// IfExpr is 'if' Condition 'then' Then 'else' Else, an 'elseif' is an IfExpr in Else
+type IfExpr struct {
+	Span
 	Condition Node
-	Step      Node
-	Block     []Node
+	Then      Node
+	Else      Node
+}
+
+func (e *IfExpr) AcceptVisitor(v Visitor) {
+	v.VisitIfExpr(e)
+}
+
+// TypeAssertion is Expr '::' Type
+type TypeAssertion struct {
+	Span
+	Expr Node
+	Type Node
+}
+
+func (e *TypeAssertion) AcceptVisitor(v Visitor) {
+	v.VisitTypeAssertion(e)
+}
+
+// NamedType is [Module '.'] Name ['<' Args '>']. The singleton types nil, true, false
+// and strings are SimpleExpr
+type NamedType struct {
+	Span
+	Module *Identifier
+	Name   *Identifier
+	Args   []Node
+}
+
+func (t *NamedType) AcceptVisitor(v Visitor) {
+	v.VisitNamedType(t)
+}
+
+// OptionalType is Type '?'
+type OptionalType struct {
+	Span
+	Type Node
+}
+
+func (t *OptionalType) AcceptVisitor(v Visitor) {
+	v.VisitOptionalType(t)
+}
+
+// UnionType is Type '|' Type {'|' Type}
+type UnionType struct {
+	Span
+	Types []Node
+}
+
+func (t *UnionType) AcceptVisitor(v Visitor) {
+	v.VisitUnionType(t)
+}
+
+// IntersectionType is Type '&' Type {'&' Type}
+type IntersectionType struct {
+	Span
+	Types []Node
+}
+
+func (t *IntersectionType) AcceptVisitor(v Visitor) {
+	v.VisitIntersectionType(t)
+}
+
+// TableType is '{' Fields '}'
+type TableType struct {
+	Span
+	Fields []Node
+}
+
+func (t *TableType) AcceptVisitor(v Visitor) {
+	v.VisitTableType(t)
+}
+
+// TypeField is Name ':' Value or '[' Key ']' ':' Value in a table type, or the Value
+// alone for the array shorthand '{' Value '}'. Named parameters of function types are TypeFields too
+type TypeField struct {
+	Span
+	Name  *Identifier
+	Key   Node
+	Value Node
+}
+
+func (t *TypeField) AcceptVisitor(v Visitor) {
+	v.VisitTypeField(t)
+}
+
+// FunctionType is ['<' TypeParams '>'] '(' Params ')' '->' Returns
+type FunctionType struct {
+	Span
+	TypeParams []Node
+	Params     []Node
+	Returns    []Node
+}
+
+func (t *FunctionType) AcceptVisitor(v Visitor) {
+	v.VisitFunctionType(t)
+}
+
+// TypeofType is 'typeof' '(' Expr ')'
+type TypeofType struct {
+	Span
+	Expr Node
+}
+
+func (t *TypeofType) AcceptVisitor(v Visitor) {
+	v.VisitTypeofType(t)
+}
+
+// VariadicType is '...' Type
+type VariadicType struct {
+	Span
+	Type Node
+}
+
+func (t *VariadicType) AcceptVisitor(v Visitor) {
+	v.VisitVariadicType(t)
+}
+
+// ErrorNode replaces a region that failed to parse when the parser recovers from errors
+type ErrorNode struct {
+	Span
+	Err error
 }
 
-func (s *ForStmnt) AcceptVisitor(v Visitor) {
-	v.VisitForStmnt(s)
+func (e *ErrorNode) AcceptVisitor(v Visitor) {
+	v.VisitErrorNode(e)
 }
@@ -0,0 +1,54 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+
+	"../lexer"
+)
+
+// SyntaxError is reported when the parser finds a token it did not expect.
+// Expected holds the tokens that would have been accepted, Msg describes the
+// expected construct when it is not a single token (e.g. "expression")
+type SyntaxError struct {
+	Pos      lexer.Position
+	Expected []lexer.TokenType
+	Msg      string
+	Found    lexer.Token
+}
+
+func (e *SyntaxError) Error() string {
+	expected := e.Msg
+	if expected == "" {
+		names := make([]string, len(e.Expected))
+		for i, tt := range e.Expected {
+			names[i] = fmt.Sprintf("'%s'", tt)
+		}
+		expected = strings.Join(names, " or ")
+	}
+	return fmt.Sprintf("%d:%d: expected %s, found %s", e.Pos.Line, e.Pos.Col, expected, foundText(e.Found))
+}
+
+func foundText(t lexer.Token) string {
+	if t.Type == lexer.EOF || t.Val == "" {
+		return t.Type.String()
+	}
+	if t.Type == lexer.STRING {
+		return t.Raw
+	}
+	return fmt.Sprintf("'%s'", t.Val)
+}
+
+// NameError is reported for a name the grammar accepts but the language does not:
+// a goto without a visible label or jumping into the scope of a local, a label defined twice
+// where both are visible, an unknown local attribute or a second 'close' one in a local list.
+// Parsing goes on after a NameError
+type NameError struct {
+	Pos  lexer.Position
+	Name string
+	Msg  string
+}
+
+func (e *NameError) Error() string {
+	return fmt.Sprintf("%d:%d: %s '%s'", e.Pos.Line, e.Pos.Col, e.Msg, e.Name)
+}
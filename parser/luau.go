@@ -0,0 +1,503 @@
+package parser
+
+import (
+	"../lexer"
+)
+
+// compoundOp maps the Luau compound assignments to their binary operator
+var compoundOp = map[lexer.TokenType]lexer.TokenType{
+	lexer.PLUSASSIGN:   lexer.PLUS,
+	lexer.MINUSASSIGN:  lexer.MINUS,
+	lexer.MULTASSIGN:   lexer.MULT,
+	lexer.DIVASSIGN:    lexer.DIV,
+	lexer.IDIVASSIGN:   lexer.IDIV,
+	lexer.MODASSIGN:    lexer.MOD,
+	lexer.POWASSIGN:    lexer.POW,
+	lexer.CONCATASSIGN: lexer.CONCAT,
+}
+
+// continuesName reports whether tt after a name makes it the start of an expression statement,
+// so that continue and type can still be used as variables
+func continuesName(tt lexer.TokenType) bool {
+	switch tt {
+	case lexer.DOT, lexer.LBRACE, lexer.COLON, lexer.LPAR, lexer.LCBRACE, lexer.STRING, lexer.ASSIGN, lexer.COMMA:
+		return true
+	}
+	_, ok := compoundOp[tt]
+	return ok
+}
+
+// AnyType reports whether a list of optional type annotations, like the Types of a local
+// assignment, holds any type
+func AnyType(types []Node) bool {
+	for _, t := range types {
+		if t != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// luauStatement parses the statements starting with a contextual Luau keyword,
+// ok is false when crr is an ordinary name
+func (p *Parser) luauStatement(crr lexer.Token) (Node, bool) {
+	next := p.peek()
+	switch {
+	case crr.Val == "continue" && !continuesName(next.Type):
+		p.next()
+		return &ContinueStmnt{Span: tokenSpan(crr)}, true
+	case crr.Val == "type" && next.Type == lexer.IDENTIFIER,
+		crr.Val == "export" && next.Type == lexer.IDENTIFIER && next.Val == "type":
+		return p.typeDeclaration(), true
+	}
+	return nil, false
+}
+
+// typeDeclaration parses ['export'] 'type' Name ['<' TypeParams '>'] '=' Type
+func (p *Parser) typeDeclaration() Node {
+	start := p.mark()
+	crr, _ := p.current()
+	export := crr.Val == "export"
+	if export {
+		p.next()
+	}
+	p.next() // 'type'
+
+	name := p.name()
+	if name == nil {
+		return nil
+	}
+	var typeParams []Node
+	crr, _ = p.current()
+	if crr.Type == lexer.LESSER {
+		if typeParams = p.typeParams(); typeParams == nil {
+			return nil
+		}
+	}
+	if !p.expect(lexer.ASSIGN) {
+		return nil
+	}
+	t := p.typeExpr()
+	if t == nil {
+		return nil
+	}
+	return &TypeDecl{Export: export, Name: name, TypeParams: typeParams, Type: t, Span: p.spanFrom(start)}
+}
+
+func (p *Parser) compoundAssignment(start mark, variable Node, op lexer.TokenType) Node {
+	if !isVar(variable) {
+		p.errorExpected("variable")
+		return nil
+	}
+	p.next()
+	expr := p.expression()
+	if expr == nil {
+		return nil
+	}
+	return &CompoundAssignment{Op: op, Var: variable, Expr: expr, Span: p.spanFrom(start)}
+}
+
+// ifExpr parses 'if' expr 'then' expr {'elseif' expr 'then' expr} 'else' expr
+func (p *Parser) ifExpr() Node {
+	start := p.mark()
+	p.next() // 'if' or 'elseif'
+	cond := p.expression()
+	if cond == nil || !p.expect(lexer.THEN) {
+		return nil
+	}
+	then := p.expression()
+	if then == nil {
+		return nil
+	}
+
+	var elseExpr Node
+	crr, _ := p.current()
+	if crr.Type == lexer.ELSEIF {
+		elseExpr = p.ifExpr()
+	} else if p.expect(lexer.ELSE) {
+		elseExpr = p.expression()
+	}
+	if elseExpr == nil {
+		return nil
+	}
+	return &IfExpr{Condition: cond, Then: then, Else: elseExpr, Span: p.spanFrom(start)}
+}
+
+// typeAssertion parses the optional '::' Type after a simple expression starting at start
+func (p *Parser) typeAssertion(expr Node, start mark) Node {
+	crr, err := p.current()
+	if expr == nil || err != nil || !p.dialect.HasTypes() || crr.Type != lexer.DBCOLON {
+		return expr
+	}
+	p.next()
+	t := p.typeExpr()
+	if t == nil {
+		return nil
+	}
+	return &TypeAssertion{Expr: expr, Type: t, Span: p.spanFrom(start)}
+}
+
+// typeAnnotation parses the optional ':' Type after a declared name
+func (p *Parser) typeAnnotation() Node {
+	crr, err := p.current()
+	if err != nil || !p.dialect.HasTypes() || crr.Type != lexer.COLON {
+		return nil
+	}
+	p.next()
+	return p.typeExpr()
+}
+
+// typedNameList parses Name [':' Type] {',' Name [':' Type]}
+func (p *Parser) typedNameList() ([]Node, []Node) {
+	var names, types []Node
+	for {
+		name := p.name()
+		if name == nil {
+			return nil, nil
+		}
+		names = append(names, name)
+		types = append(types, p.typeAnnotation())
+		if p.panicking {
+			return nil, nil
+		}
+
+		crr, _ := p.current()
+		if crr.Type != lexer.COMMA {
+			return names, types
+		}
+		p.next()
+	}
+}
+
+// typeParams parses '<' Name {',' Name} '>'
+func (p *Parser) typeParams() []Node {
+	p.next() // '<'
+	var params []Node
+	for {
+		name := p.name()
+		if name == nil {
+			return nil
+		}
+		params = append(params, name)
+
+		crr, _ := p.current()
+		if crr.Type != lexer.COMMA {
+			break
+		}
+		p.next()
+	}
+	if !p.expect(lexer.GREATER) {
+		return nil
+	}
+	return params
+}
+
+// typeArgs parses '<' TypeOrPack {',' TypeOrPack} '>'
+func (p *Parser) typeArgs() []Node {
+	p.next() // '<'
+	var args []Node
+	for {
+		t := p.typeOrPack()
+		if t == nil {
+			return nil
+		}
+		args = append(args, t)
+
+		crr, _ := p.current()
+		if crr.Type != lexer.COMMA {
+			break
+		}
+		p.next()
+	}
+	if !p.expect(lexer.GREATER) {
+		return nil
+	}
+	return args
+}
+
+// typeExpr parses OptionalType {('|' | '&') OptionalType}, '|' and '&' cannot be mixed without parentheses
+func (p *Parser) typeExpr() Node {
+	start := p.mark()
+	first := p.optionalType()
+	if first == nil {
+		return nil
+	}
+	crr, _ := p.current()
+	op := crr.Type
+	if op != lexer.BOR && op != lexer.BAND {
+		return first
+	}
+
+	types := []Node{first}
+	for crr.Type == op {
+		p.next()
+		t := p.optionalType()
+		if t == nil {
+			return nil
+		}
+		types = append(types, t)
+		crr, _ = p.current()
+	}
+	if op == lexer.BOR {
+		return &UnionType{Types: types, Span: p.spanFrom(start)}
+	}
+	return &IntersectionType{Types: types, Span: p.spanFrom(start)}
+}
+
+// optionalType parses SimpleType {'?'}
+func (p *Parser) optionalType() Node {
+	start := p.mark()
+	t := p.simpleType()
+	if t == nil {
+		return nil
+	}
+	crr, _ := p.current()
+	for crr.Type == lexer.QUESTION {
+		p.next()
+		t = &OptionalType{Type: t, Span: p.spanFrom(start)}
+		crr, _ = p.current()
+	}
+	return t
+}
+
+// simpleType parses nil | true | false | String | NamedType | 'typeof' '(' expr ')' |
+// TableType | FunctionType | '(' Type ')'
+func (p *Parser) simpleType() Node {
+	crr, err := p.current()
+	if err != nil {
+		return nil
+	}
+
+	start := p.mark()
+	switch crr.Type {
+	case lexer.NIL, lexer.TRUE, lexer.FALSE, lexer.STRING:
+		p.next()
+		return &SimpleExpr{Type: crr.Type, Val: crr.Val, Raw: crr.Raw, Span: tokenSpan(crr)}
+	case lexer.IDENTIFIER:
+		if crr.Val == "typeof" && p.peek().Type == lexer.LPAR {
+			p.next()
+			p.next()
+			expr := p.expression()
+			if expr == nil || !p.expect(lexer.RPAR) {
+				return nil
+			}
+			return &TypeofType{Expr: expr, Span: p.spanFrom(start)}
+		}
+		return p.namedType()
+	case lexer.LCBRACE:
+		return p.tableType()
+	case lexer.LESSER:
+		typeParams := p.typeParams()
+		if typeParams == nil {
+			return nil
+		}
+		params := p.parenTypeList()
+		if params == nil {
+			return nil
+		}
+		return p.functionType(start, typeParams, params)
+	case lexer.LPAR:
+		params := p.parenTypeList()
+		if params == nil {
+			return nil
+		}
+		crr, _ = p.current()
+		if crr.Type == lexer.ARROW {
+			return p.functionType(start, nil, params)
+		}
+		// a parenthesized type
+		if len(params) == 1 {
+			switch params[0].(type) {
+			case *VariadicType, *TypeField:
+			default:
+				return params[0]
+			}
+		}
+		p.errorExpected("", lexer.ARROW)
+		return nil
+	}
+	p.errorExpected("type")
+	return nil
+}
+
+// namedType parses Name ['.' Name] ['<' TypeArgs '>']
+func (p *Parser) namedType() Node {
+	start := p.mark()
+	name := p.name()
+	if name == nil {
+		return nil
+	}
+	var module *Identifier
+	crr, _ := p.current()
+	if crr.Type == lexer.DOT {
+		p.next()
+		module = name
+		if name = p.name(); name == nil {
+			return nil
+		}
+	}
+	var args []Node
+	crr, _ = p.current()
+	if crr.Type == lexer.LESSER {
+		if args = p.typeArgs(); args == nil {
+			return nil
+		}
+	}
+	return &NamedType{Module: module, Name: name, Args: args, Span: p.spanFrom(start)}
+}
+
+// tableType parses '{' [TypeField {fieldSep TypeField} [fieldSep]] '}'
+func (p *Parser) tableType() Node {
+	start := p.mark()
+	p.next() // '{'
+	var fields []Node
+	crr, _ := p.current()
+	for crr.Type != lexer.RCBRACE {
+		field := p.typeField()
+		if field == nil {
+			return nil
+		}
+		fields = append(fields, field)
+
+		crr, _ = p.current()
+		if crr.Type != lexer.COMMA && crr.Type != lexer.SEMICOLON {
+			break
+		}
+		p.next()
+		crr, _ = p.current()
+	}
+	if !p.expect(lexer.RCBRACE) {
+		return nil
+	}
+	return &TableType{Fields: fields, Span: p.spanFrom(start)}
+}
+
+// typeField parses '[' Type ']' ':' Type | Name ':' Type | Type
+func (p *Parser) typeField() Node {
+	crr, err := p.current()
+	if err != nil {
+		return nil
+	}
+
+	start := p.mark()
+	switch {
+	case crr.Type == lexer.LBRACE:
+		p.next()
+		key := p.typeExpr()
+		if key == nil || !p.expect(lexer.RBRACE) || !p.expect(lexer.COLON) {
+			return nil
+		}
+		value := p.typeExpr()
+		if value == nil {
+			return nil
+		}
+		return &TypeField{Key: key, Value: value, Span: p.spanFrom(start)}
+	case crr.Type == lexer.IDENTIFIER && p.peek().Type == lexer.COLON:
+		return p.namedTypeField()
+	}
+	value := p.typeExpr()
+	if value == nil {
+		return nil
+	}
+	return &TypeField{Value: value, Span: p.spanFrom(start)}
+}
+
+// namedTypeField parses Name ':' Type
+func (p *Parser) namedTypeField() Node {
+	start := p.mark()
+	name := p.name()
+	p.next() // ':'
+	value := p.typeExpr()
+	if value == nil {
+		return nil
+	}
+	return &TypeField{Name: name, Value: value, Span: p.spanFrom(start)}
+}
+
+// typeOrPack parses '...' Type | Type
+func (p *Parser) typeOrPack() Node {
+	crr, err := p.current()
+	if err != nil || crr.Type != lexer.VARAGS {
+		return p.typeExpr()
+	}
+	start := p.mark()
+	p.next()
+	t := p.typeExpr()
+	if t == nil {
+		return nil
+	}
+	return &VariadicType{Type: t, Span: p.spanFrom(start)}
+}
+
+// parenTypeList parses '(' [entry {',' entry}] ')' where an entry is TypeOrPack or
+// a named parameter of a function type
+func (p *Parser) parenTypeList() []Node {
+	if !p.expect(lexer.LPAR) {
+		return nil
+	}
+	types := []Node{}
+	crr, _ := p.current()
+	for crr.Type != lexer.RPAR {
+		var t Node
+		if crr.Type == lexer.IDENTIFIER && p.peek().Type == lexer.COLON {
+			t = p.namedTypeField()
+		} else {
+			t = p.typeOrPack()
+		}
+		if t == nil {
+			return nil
+		}
+		types = append(types, t)
+
+		crr, _ = p.current()
+		if crr.Type != lexer.COMMA {
+			break
+		}
+		p.next()
+		crr, _ = p.current()
+	}
+	if !p.expect(lexer.RPAR) {
+		return nil
+	}
+	return types
+}
+
+// functionType parses the '->' ReturnType after the parameters of a function type
+func (p *Parser) functionType(start mark, typeParams, params []Node) Node {
+	if !p.expect(lexer.ARROW) {
+		return nil
+	}
+	returns := p.returnType()
+	if returns == nil {
+		return nil
+	}
+	return &FunctionType{TypeParams: typeParams, Params: params, Returns: returns, Span: p.spanFrom(start)}
+}
+
+// returnType parses TypeOrPack | '(' [TypeList] ')' | FunctionType
+func (p *Parser) returnType() []Node {
+	crr, err := p.current()
+	if err != nil {
+		return nil
+	}
+	if crr.Type == lexer.LPAR {
+		start := p.mark()
+		types := p.parenTypeList()
+		if types == nil {
+			return nil
+		}
+		crr, _ = p.current()
+		if crr.Type != lexer.ARROW {
+			return types
+		}
+		if t := p.functionType(start, nil, types); t != nil {
+			return []Node{t}
+		}
+		return nil
+	}
+	t := p.typeOrPack()
+	if t == nil {
+		return nil
+	}
+	return []Node{t}
+}
@@ -2,7 +2,6 @@ package parser
 
 import (
 	"errors"
-	"fmt"
 
 	"../lexer"
 )
@@ -11,69 +10,454 @@ import (
 type Parser struct {
 	tokens        []lexer.Token
 	topstatements Program
+	shebang       string
 	i             int
+	errs          []error
+	panicking     bool
+	recovery      bool
+	scopes        []*labelScope
+	dialect       lexer.Dialect
+
+	// a streaming parser pulls its tokens from source, tokens[0] is the token at index base.
+	// end is where the last token ends
+	source TokenSource
+	base   int
+	end    lexer.Position
+
+	// the comments of the consumed tokens not attached to a node yet, seen tokens have been
+	// looked at for them. tail holds the comments at the end of the source
+	comments []pendingComments
+	seen     int
+	tail     []lexer.Token
+}
+
+// pendingComments are the comments before the token at i or, when trailing, after it
+type pendingComments struct {
+	i        int
+	trailing bool
+	tokens   []lexer.Token
+}
+
+// labelScope holds the labels of a block and the gotos inside it not yet matched to a label.
+// locals are the names of the locals declared in the block so far, a goto jumping forward
+// past some of them would enter their scope
+type labelScope struct {
+	labels   map[string]*blockLabel
+	gotos    []pendingGoto
+	function bool
+	locals   []string
+	// the labels after the last other statement of the block
+	trailing []*blockLabel
+}
+
+// blockLabel is a label and the number of locals of its block declared before it
+type blockLabel struct {
+	*LabelStmnt
+	locals int
+}
+
+// pendingGoto is a goto and the number of locals of the block it is pending in declared before it
+type pendingGoto struct {
+	*GotoStmnt
+	locals int
+}
+
+// Option configures a Parser
+type Option func(*Parser)
+
+// WithRecovery makes the parser continue after a syntax error. The broken region is
+// replaced by an ErrorNode and parsing resumes at the next statement boundary
+func WithRecovery() Option {
+	return func(p *Parser) {
+		p.recovery = true
+	}
+}
+
+// WithDialect makes the parser accept the statements of the given Lua version, Lua54 by default.
+// The lexer producing the tokens should use the same dialect
+func WithDialect(d lexer.Dialect) Option {
+	return func(p *Parser) {
+		p.dialect = d
+	}
+}
+
+// TokenSource gives the tokens of a source one at a time and an EOF token at its end,
+// a lexer.Lexer is one
+type TokenSource interface {
+	Next() (lexer.Token, error)
 }
 
 // NewParser constructs a Parser
-func NewParser(tokens []lexer.Token) Parser {
-	return Parser{tokens, nil, 0}
+func NewParser(tokens []lexer.Token, opts ...Option) Parser {
+	p := Parser{tokens: tokens, end: lexer.Position{Line: 1, Col: 1}}
+	if last := len(tokens) - 1; last >= 0 && tokens[last].Type == lexer.EOF {
+		// the EOF token of a lexer keeping trivia
+		p.tokens = tokens[:last]
+		p.tail = triviaComments(tokens[last], false)
+	}
+	if len(p.tokens) > 0 {
+		p.end = p.tokens[len(p.tokens)-1].End
+	}
+	for _, opt := range opts {
+		opt(&p)
+	}
+	return p
+}
+
+// NewStreamParser constructs a Parser pulling the tokens from source as it needs them,
+// only the few it may still look at are kept. A lexical error ends the tokens and is returned by Run
+func NewStreamParser(source TokenSource, opts ...Option) Parser {
+	p := NewParser(nil, opts...)
+	p.source = source
+	return p
+}
+
+// unOp returns the unary operator for tt. The lexer cannot tell a negation from
+// a subtraction, a MINUS where an operand is expected is a UMINUS. The same goes for '~'
+func unOp(tt lexer.TokenType) (lexer.TokenType, bool) {
+	switch tt {
+	case lexer.MINUS, lexer.UMINUS:
+		return lexer.UMINUS, true
+	case lexer.BXOR, lexer.BNOT:
+		return lexer.BNOT, true
+	case lexer.NOT, lexer.HTAG:
+		return tt, true
+	}
+	return tt, false
 }
 
-func unOp(tt lexer.TokenType) bool {
-	return tt == lexer.UMINUS || tt == lexer.NOT || tt == lexer.HTAG
+type priority struct {
+	left  int
+	right int
 }
 
-func prodOp(tt lexer.TokenType) bool {
-	return tt == lexer.MULT || tt == lexer.DIV || tt == lexer.POW
+// binaryPriority is the binding power of each binary operator as in the reference manual,
+// a right priority lower than the left one makes the operator right associative
+var binaryPriority = map[lexer.TokenType]priority{
+	lexer.OR:       {1, 1},
+	lexer.AND:      {2, 2},
+	lexer.LESSER:   {3, 3},
+	lexer.LESSERQ:  {3, 3},
+	lexer.GREATER:  {3, 3},
+	lexer.GREATERQ: {3, 3},
+	lexer.EQ:       {3, 3},
+	lexer.NOTEQ:    {3, 3},
+	lexer.BOR:      {4, 4},
+	lexer.BXOR:     {5, 5},
+	lexer.BAND:     {6, 6},
+	lexer.SHL:      {7, 7},
+	lexer.SHR:      {7, 7},
+	lexer.CONCAT:   {9, 8},
+	lexer.PLUS:     {10, 10},
+	lexer.MINUS:    {10, 10},
+	lexer.MULT:     {11, 11},
+	lexer.DIV:      {11, 11},
+	lexer.IDIV:     {11, 11},
+	lexer.MOD:      {11, 11},
+	lexer.POW:      {14, 13},
 }
 
-func sumOp(tt lexer.TokenType) bool {
-	return tt == lexer.PLUS || tt == lexer.MINUS || tt == lexer.CONCAT || tt == lexer.MOD
+// unaryPriority binds unary operators tighter than every binary operator except '^'
+const unaryPriority = 12
+
+// binaryOp returns the priority of tt when it is a binary operator of the dialect,
+// in Luau '|' and '&' are only used in types
+func (p *Parser) binaryOp(tt lexer.TokenType) (priority, bool) {
+	if p.dialect.HasTypes() && (tt == lexer.BOR || tt == lexer.BAND) {
+		return priority{}, false
+	}
+	prio, ok := binaryPriority[tt]
+	return prio, ok
+}
+
+// blockFollow reports whether tt ends a block
+func blockFollow(tt lexer.TokenType) bool {
+	return tt == lexer.END || tt == lexer.ELSE || tt == lexer.ELSEIF || tt == lexer.UNTIL || tt == lexer.EOF
+}
+
+// syncToken reports whether tt is a statement boundary to resume parsing at after an error
+func syncToken(tt lexer.TokenType) bool {
+	switch tt {
+	case lexer.END, lexer.ELSE, lexer.ELSEIF, lexer.UNTIL, lexer.LOCAL, lexer.FUNCTION, lexer.RETURN,
+		lexer.IF, lexer.WHILE, lexer.FOR, lexer.DO, lexer.REPEAT, lexer.BREAK, lexer.SEMICOLON,
+		lexer.GOTO, lexer.DBCOLON:
+		return true
+	}
+	return false
 }
 
-func relOp(tt lexer.TokenType) bool {
-	return tt == lexer.LESSER || tt == lexer.LESSERQ || tt == lexer.GREATER || tt == lexer.GREATERQ || tt == lexer.EQ
+// resumeAt reports whether parsing may resume at t after an error, prev is the token before it.
+// An identifier or '(' starting a line most likely starts a statement, and so does an identifier
+// right after a token ending an expression, where it cannot go on the expression
+func resumeAt(prev, t lexer.Token) bool {
+	if syncToken(t.Type) {
+		return true
+	}
+	newLine := t.Start.Line > prev.End.Line
+	switch t.Type {
+	case lexer.IDENTIFIER:
+		return newLine || termExpr(prev.Type) || prev.Type == lexer.IDENTIFIER || prev.Type == lexer.RPAR ||
+			prev.Type == lexer.RBRACE || prev.Type == lexer.RCBRACE || prev.Type == lexer.END
+	case lexer.LPAR:
+		return newLine
+	}
+	return false
 }
 
 func termExpr(tt lexer.TokenType) bool {
-	return tt == lexer.NIL || tt == lexer.FALSE || tt == lexer.TRUE || tt == lexer.NUMBER || tt == lexer.STRING
+	return tt == lexer.NIL || tt == lexer.FALSE || tt == lexer.TRUE || tt == lexer.NUMBER || tt == lexer.STRING || tt == lexer.VARAGS
+}
+
+// token returns the token at index i, ok is false past the last one
+func (p *Parser) token(i int) (t lexer.Token, ok bool) {
+	for p.source != nil && i >= p.base+len(p.tokens) {
+		t, err := p.source.Next()
+		if err != nil {
+			p.errs = append(p.errs, err)
+		}
+		if err != nil || t.Type == lexer.EOF {
+			p.tail = triviaComments(t, false)
+			p.source = nil
+			break
+		}
+		p.tokens = append(p.tokens, t)
+		p.end = t.End
+	}
+	if i < p.base || i >= p.base+len(p.tokens) {
+		return lexer.Token{}, false
+	}
+	return p.tokens[i-p.base], true
 }
 
 func (p *Parser) hasTokens() bool {
-	return len(p.tokens) > 0
+	_, ok := p.token(0)
+	return ok
 }
 
 func (p *Parser) current() (lexer.Token, error) {
-	if p.i >= len(p.tokens) {
-		return lexer.Token{}, errors.New("No more tokens")
+	if p.panicking {
+		return p.eof(), errors.New("Syntax error")
+	}
+	t, ok := p.token(p.i)
+	if !ok {
+		return p.eof(), errors.New("No more tokens")
+	}
+	return t, nil
+}
+
+// peek returns the token after the current one
+func (p *Parser) peek() lexer.Token {
+	t, ok := p.token(p.i + 1)
+	if p.panicking || !ok {
+		return p.eof()
+	}
+	return t
+}
+
+// eof returns an EOF token placed right after the last token
+func (p *Parser) eof() lexer.Token {
+	return lexer.Token{Type: lexer.EOF, Start: p.end, End: p.end}
+}
+
+// errorExpected records a SyntaxError at the current token.
+// After an error current() fails, so the parse functions unwind without consuming more tokens
+func (p *Parser) errorExpected(msg string, expected ...lexer.TokenType) {
+	if p.panicking {
+		return
+	}
+	found, ok := p.token(p.i)
+	if !ok {
+		found = p.eof()
 	}
-	return p.tokens[p.i], nil
+	p.errs = append(p.errs, &SyntaxError{Pos: found.Start, Expected: expected, Msg: msg, Found: found})
+	p.panicking = true
 }
 
+// synchronize skips to the next statement boundary after a syntax error
+// and returns an ErrorNode covering the tokens from start
+func (p *Parser) synchronize(start mark, errN int) Node {
+	p.panicking = false
+	if p.i <= start.i {
+		p.i = start.i
+		p.next()
+	}
+	for t, ok := p.token(p.i); ok; t, ok = p.token(p.i) {
+		if prev, _ := p.token(p.i - 1); resumeAt(prev, t) {
+			break
+		}
+		p.next()
+	}
+
+	var err error
+	if errN < len(p.errs) {
+		err = p.errs[errN]
+	}
+	return &ErrorNode{Err: err, Span: p.spanFrom(start)}
+}
+
+// expect consumes the current token if it is of type tt, otherwise records an error
+func (p *Parser) expect(tt lexer.TokenType) bool {
+	crr, err := p.current()
+	if err == nil && crr.Type == tt {
+		p.next()
+		return true
+	}
+	p.errorExpected("", tt)
+	return false
+}
+
+// expression parses an expression required by the grammar
+func (p *Parser) expression() Node {
+	expr := p.parseExpression()
+	if expr == nil {
+		p.errorExpected("expression")
+	}
+	return expr
+}
 func (p *Parser) next() {
+	if p.i >= p.seen {
+		p.seen = p.i + 1
+		if t, ok := p.token(p.i); ok {
+			if leading := triviaComments(t, false); leading != nil {
+				p.comments = append(p.comments, pendingComments{i: p.i, tokens: leading})
+			}
+			if trailing := triviaComments(t, true); trailing != nil {
+				p.comments = append(p.comments, pendingComments{i: p.i, trailing: true, tokens: trailing})
+			}
+		}
+	}
 	p.i++
+	// a stream drops the tokens before the last consumed one, in batches to copy less
+	if p.source != nil && p.i-p.base > 1024 {
+		n := p.i - 1 - p.base
+		p.tokens = append(p.tokens[:0], p.tokens[n:]...)
+		p.base += n
+	}
 }
 
-func (p *Parser) varList() []Node {
-	crr, err := p.current()
-	if err != nil {
-		return nil
+// mark is the position of the current token, where a node starts
+type mark struct {
+	i     int
+	token lexer.Token
+	eof   bool
+}
+
+func (p *Parser) mark() mark {
+	t, ok := p.token(p.i)
+	return mark{i: p.i, token: t, eof: !ok}
+}
+
+// lastEnd returns the end of the last consumed token
+func (p *Parser) lastEnd() lexer.Position {
+	if t, ok := p.token(p.i - 1); ok {
+		return t.End
 	}
+	return p.end
+}
 
-	list := make([]Node, 0, 5)
-	variable := p.parseVar()
-	if variable == nil {
+// spanFrom returns the span from the token at start to the last consumed token
+func (p *Parser) spanFrom(start mark) Span {
+	if start.eof {
+		return Span{}
+	}
+	if p.i-1 < start.i {
+		return tokenSpan(start.token)
+	}
+	return Span{Start: start.token.Start, End: p.lastEnd()}
+}
+
+// spanAfter returns the span from the start of n to the last consumed token
+func (p *Parser) spanAfter(n Node) Span {
+	span := Span{Start: spanOf(n).Start, End: spanOf(n).End}
+	if p.i > 0 {
+		span.End = p.lastEnd()
+	}
+	return span
+}
+
+// attachComments gives node the comments before its first token at start, after the last
+// consumed token on the same line and the ones between its tokens not attached to a nested node
+func (p *Parser) attachComments(node Node, start mark) {
+	p.attach(node, start, true)
+}
+
+// attachInner gives node the comments between its tokens not attached to a nested node,
+// the ones around it are left to the enclosing statement
+func (p *Parser) attachInner(node Node, start mark) {
+	p.attach(node, start, false)
+}
+
+func (p *Parser) attach(node Node, start mark, around bool) {
+	n, ok := node.(interface{ addComments(Comments) })
+	if !ok || start.eof || p.i <= start.i {
+		return
+	}
+	last := p.i - 1
+	var comments Comments
+	kept := p.comments[:0]
+	for _, c := range p.comments {
+		switch {
+		case c.i < start.i || c.i > last:
+			kept = append(kept, c)
+		case c.i == start.i && !c.trailing:
+			if !around {
+				kept = append(kept, c)
+				continue
+			}
+			comments.Leading = append(comments.Leading, c.tokens...)
+		case c.i == last && c.trailing:
+			if !around {
+				kept = append(kept, c)
+				continue
+			}
+			comments.Trailing = append(comments.Trailing, c.tokens...)
+		default:
+			comments.Inner = append(comments.Inner, c.tokens...)
+		}
+	}
+	p.comments = kept
+	if comments.Leading != nil || comments.Inner != nil || comments.Trailing != nil {
+		n.addComments(comments)
+	}
+}
+
+// attachRest makes the comments no node took, like the ones at the end of the source,
+// trail the last statement
+func (p *Parser) attachRest(statements []Node) {
+	var rest []lexer.Token
+	for _, c := range p.comments {
+		rest = append(rest, c.tokens...)
+	}
+	rest = append(rest, p.tail...)
+	p.comments, p.tail = nil, nil
+	if len(statements) == 0 || rest == nil {
+		return
+	}
+	if n, ok := statements[len(statements)-1].(interface{ addComments(Comments) }); ok {
+		n.addComments(Comments{Trailing: rest})
+	}
+}
+
+// triviaComments returns the comments before t or, when trailing, after it
+func triviaComments(t lexer.Token, trailing bool) []lexer.Token {
+	if t.Trivia == nil {
 		return nil
 	}
-	list = append(list, variable)
-	crr, _ = p.current()
-	for crr.Type == lexer.COMMA {
-		p.next()
-		variable = p.parseVar()
-		list = append(list, variable)
-		crr, _ = p.current()
+	trivia := t.Trivia.Leading
+	if trailing {
+		trivia = t.Trivia.Trailing
 	}
-	return list
+	var comments []lexer.Token
+	for _, t := range trivia {
+		if t.Type == lexer.COMMENT {
+			comments = append(comments, t)
+		}
+	}
+	return comments
+}
+
+func tokenSpan(t lexer.Token) Span {
+	return Span{Start: t.Start, End: t.End}
 }
 
 func (p *Parser) exprList() []Node {
@@ -89,7 +473,7 @@ func (p *Parser) exprList() []Node {
 		crr, _ = p.current()
 		for crr.Type == lexer.COMMA {
 			p.next()
-			expr = p.parseExpression()
+			expr = p.expression()
 			list = append(list, expr)
 			crr, _ = p.current()
 		}
@@ -104,37 +488,42 @@ func (p *Parser) parseField() Node {
 	}
 
 	var key Node
+	start := p.mark()
 
 	if crr.Type == lexer.LBRACE {
 		p.next()
-		key = p.parseExpression()
-		p.next() // ']'
-
-		crr, _ = p.current()
-		if crr.Type != lexer.ASSIGN {
+		key = p.expression()
+		if !p.expect(lexer.RBRACE) || !p.expect(lexer.ASSIGN) {
 			return nil
 		}
-		p.next()
 
 	} else if crr.Type == lexer.IDENTIFIER {
 		p.next()
-		key = &Identifier{crr.Val}
+		key = &Identifier{Name: crr.Val, Span: tokenSpan(crr)}
 		crr, _ = p.current()
 		if crr.Type != lexer.ASSIGN {
 			p.i--
-			return &KeyExpr{nil, p.parseExpression()}
+			expr := p.parseExpression()
+			return &KeyExpr{RightExpr: expr, Span: p.spanFrom(start)}
 		}
 		p.next()
+	} else {
+		expr := p.parseExpression()
+		if expr == nil {
+			return nil
+		}
+		return &KeyExpr{RightExpr: expr, Span: p.spanFrom(start)}
 	}
 
-	expr := p.parseExpression()
-	return &KeyExpr{key, expr}
+	expr := p.expression()
+	return &KeyExpr{LeftExpr: key, RightExpr: expr, Span: p.spanFrom(start)}
 }
 
 func (p *Parser) parseFieldList() []Node {
 
 	fieldList := make([]Node, 0, 10)
 
+	start := p.mark()
 	field := p.parseField()
 
 	crr, err := p.current()
@@ -147,9 +536,13 @@ func (p *Parser) parseFieldList() []Node {
 		fieldList = append(fieldList, field)
 
 		if crr.Type != lexer.SEMICOLON && crr.Type != lexer.COMMA {
+			p.attachComments(field, start)
 			return fieldList
 		}
+		// the comments after the separator go with the field
 		p.next()
+		p.attachComments(field, start)
+		start = p.mark()
 		field = p.parseField()
 		crr, err = p.current()
 	}
@@ -165,12 +558,17 @@ func (p *Parser) parseTableConstructor() Node {
 	if crr.Type != lexer.LCBRACE {
 		return nil
 	}
+	start := p.mark()
 	p.next()
 
 	fieldList := p.parseFieldList()
 
-	p.next() // '}'
-	return &ConstructorExpr{fieldList}
+	if !p.expect(lexer.RCBRACE) {
+		return nil
+	}
+	constructor := &ConstructorExpr{FieldList: fieldList, Span: p.spanFrom(start)}
+	p.attachInner(constructor, start)
+	return constructor
 
 }
 
@@ -181,10 +579,13 @@ func (p *Parser) parseNameAndArgs() Node {
 	}
 
 	if crr.Type == lexer.LPAR {
+		start := p.mark()
 		p.next()
 		exprList := p.exprList()
-		p.next() // ')'
-		return ArgList(exprList)
+		p.expect(lexer.RPAR)
+		args := &ArgList{Args: exprList, Span: p.spanFrom(start)}
+		p.attachInner(args, start)
+		return args
 	}
 
 	constructor := p.parseTableConstructor()
@@ -197,24 +598,9 @@ func (p *Parser) parseNameAndArgs() Node {
 	}
 
 	p.next()
-	return &SimpleExpr{crr.Type, crr.Val}
+	return &SimpleExpr{Type: crr.Type, Val: crr.Val, Raw: crr.Raw, Span: tokenSpan(crr)}
 }
 
-func (p *Parser) assignmentStatement() Node {
-	crrI := p.i
-	vars := p.varList()
-
-	crr, _ := p.current()
-
-	if vars == nil || crr.Type != lexer.ASSIGN {
-		p.i = crrI
-		return nil
-	}
-	p.next()
-	exprs := p.exprList()
-
-	return &AssignmentExpr{vars, exprs}
-}
 func (p *Parser) statement() Node {
 
 	crr, err := p.current()
@@ -222,16 +608,6 @@ func (p *Parser) statement() Node {
 		return nil
 	}
 
-	assignment := p.assignmentStatement()
-	if assignment != nil {
-		return assignment
-	}
-
-	funcCall := p.functionCall()
-	if funcCall != nil {
-		return funcCall
-	}
-
 	switch crr.Type {
 	case lexer.DO:
 		return p.doStatement()
@@ -251,447 +627,773 @@ func (p *Parser) statement() Node {
 		return p.returnStatement()
 	case lexer.BREAK:
 		p.next()
-		return &SimpleExpr{lexer.BREAK, "break"}
+		return &SimpleExpr{Type: lexer.BREAK, Val: "break", Span: tokenSpan(crr)}
+	case lexer.GOTO:
+		return p.gotoStatement()
+	case lexer.DBCOLON:
+		return p.labelStatement()
+	case lexer.IDENTIFIER:
+		if p.dialect.HasTypes() {
+			if statement, ok := p.luauStatement(crr); ok {
+				return statement
+			}
+		}
 	}
 
-	return nil
+	return p.exprStatement()
 }
 
-func (p *Parser) returnStatement() Node {
-	p.next()
-	return ReturnList(p.exprList())
+// exprStatement parses an assignment or a function call,
+// both start with a suffixed expression
+func (p *Parser) exprStatement() Node {
+	start := p.mark()
+	expr := p.suffixedExpr()
+	if expr == nil {
+		return nil
+	}
+
+	crr, _ := p.current()
+	if op, ok := compoundOp[crr.Type]; ok && p.dialect.HasTypes() {
+		return p.compoundAssignment(start, expr, op)
+	}
+	if crr.Type != lexer.ASSIGN && crr.Type != lexer.COMMA {
+		if !isCall(expr) {
+			p.errorExpected("", lexer.ASSIGN)
+		}
+		return expr
+	}
+
+	vars := []Node{expr}
+	for crr.Type == lexer.COMMA {
+		p.next()
+		vars = append(vars, p.suffixedExpr())
+		crr, _ = p.current()
+	}
+	for _, variable := range vars {
+		if !isVar(variable) {
+			p.errorExpected("variable")
+			return nil
+		}
+	}
+	if !p.expect(lexer.ASSIGN) {
+		return nil
+	}
+	exprs := p.exprList()
+	if len(exprs) == 0 {
+		p.errorExpected("expression")
+	}
+
+	return &AssignmentExpr{Vars: vars, Exprs: exprs, Span: p.spanFrom(start)}
 }
 
-func (p *Parser) localStatement() Node {
+func isCall(n Node) bool {
+	switch n.(type) {
+	case *CallExpr, *MethodCallExpr:
+		return true
+	}
+	return false
+}
+
+func isVar(n Node) bool {
+	switch n.(type) {
+	case *Identifier, *IndexExpr, *MemberExpr:
+		return true
+	}
+	return false
+}
+
+func (p *Parser) returnStatement() Node {
+	start := p.mark()
 	p.next()
+	exprs := p.exprList()
+	ret := &ReturnList{Exprs: exprs, Span: p.spanFrom(start)}
 
+	// return is the last statement of its block, an optional ';' may follow it
 	crr, err := p.current()
-	if err != nil {
-		return nil
+	if err == nil && crr.Type == lexer.SEMICOLON {
+		p.next()
+		crr, err = p.current()
 	}
+	if err == nil && !blockFollow(crr.Type) {
+		p.errorExpected("end of block after return")
+	}
+	return ret
+}
 
+func (p *Parser) localStatement() Node {
+	start := p.mark()
+	p.next()
+	namesStart := p.mark()
+
+	crr, _ := p.current()
 	if crr.Type == lexer.FUNCTION {
 		namedFunction, assert := p.functionStatement().(*NamedFunction)
 		if assert && namedFunction != nil {
-			return &LocalFunction{namedFunction}
+			if name, ok := namedFunction.FunctionName.(*Identifier); ok {
+				p.declare(name)
+			}
+			return &LocalFunction{NamedFunction: namedFunction, Span: p.spanFrom(start)}
 		}
+		return nil
 	}
 
-	assignment, assert := p.assignmentStatement().(*AssignmentExpr)
-	if assert && assignment != nil {
-		return &LocalAssignmentExpr{assignment}
+	var vars, types []Node
+	var attribs []string
+	if p.dialect.HasTypes() {
+		vars, types = p.typedNameList()
+	} else {
+		vars, attribs = p.attribNameList()
+	}
+	if vars == nil {
+		return nil
+	}
+	var exprs []Node
+	crr, _ = p.current()
+	if crr.Type == lexer.ASSIGN {
+		p.next()
+		exprs = p.exprList()
+		if len(exprs) == 0 {
+			p.errorExpected("expression")
+		}
 	}
 
-	return nil
+	for _, name := range vars {
+		p.declare(name.(*Identifier))
+	}
+	assignment := &AssignmentExpr{Vars: vars, Exprs: exprs, Span: p.spanFrom(namesStart)}
+	return &LocalAssignmentExpr{AssignmentExpr: assignment, Attribs: attribs, Types: types, Span: p.spanFrom(start)}
+}
+
+// attribNameList parses Id attrib (',' Id attrib)*, attrib is ['<' Id '>'].
+// The attributes are returned in the order of the names, "" for a name without one
+func (p *Parser) attribNameList() ([]Node, []string) {
+	var names []Node
+	var attribs []string
+	closed := false
+	for {
+		crr, err := p.current()
+		if err != nil || crr.Type != lexer.IDENTIFIER {
+			p.errorExpected("", lexer.IDENTIFIER)
+			return nil, nil
+		}
+		names = append(names, &Identifier{Name: crr.Val, Span: tokenSpan(crr)})
+		p.next()
+
+		attrib := ""
+		crr, _ = p.current()
+		if crr.Type == lexer.LESSER {
+			p.next()
+			name := p.name()
+			if name == nil || !p.expect(lexer.GREATER) {
+				return nil, nil
+			}
+			attrib = name.Name
+			if !p.dialect.HasAttribs() {
+				p.errs = append(p.errs, &NameError{Pos: name.Start, Name: attrib, Msg: p.dialect.String() + " does not support the attribute"})
+			} else if attrib != "const" && attrib != "close" {
+				p.errs = append(p.errs, &NameError{Pos: name.Start, Name: attrib, Msg: "unknown attribute"})
+			} else if attrib == "close" && closed {
+				p.errs = append(p.errs, &NameError{Pos: name.Start, Name: attrib, Msg: "multiple to-be-closed variables in local list"})
+			}
+			closed = closed || attrib == "close"
+		}
+		attribs = append(attribs, attrib)
+
+		crr, _ = p.current()
+		if crr.Type != lexer.COMMA {
+			return names, attribs
+		}
+		p.next()
+	}
+}
+
+func (p *Parser) nameList() []Node {
+	var names []Node
+	for {
+		crr, err := p.current()
+		if err != nil || crr.Type != lexer.IDENTIFIER {
+			p.errorExpected("", lexer.IDENTIFIER)
+			return nil
+		}
+		names = append(names, &Identifier{Name: crr.Val, Span: tokenSpan(crr)})
+		p.next()
+
+		crr, _ = p.current()
+		if crr.Type != lexer.COMMA {
+			return names
+		}
+		p.next()
+	}
 }
 
 func (p *Parser) functionStatement() Node {
+	start := p.mark()
 	p.next()
 
 	// function name
-	crr, _ := p.current()
-	if crr.Type != lexer.IDENTIFIER {
+	var id Node
+	id = p.name()
+	if id == nil {
 		return nil
 	}
-	var id Node
-	id = &Identifier{crr.Val}
-	p.next()
 
-	crr, _ = p.current()
+	crr, _ := p.current()
 	for crr.Type == lexer.DOT {
 		p.next()
-		id = &MemberExpr{id, &Identifier{crr.Val}}
-		p.next()
+		field := p.name()
+		if field == nil {
+			return nil
+		}
+		id = &MemberExpr{Obj: id, Field: field, Span: p.spanAfter(id)}
 		crr, _ = p.current()
 	}
 
-	p.next()
-	var args []Node
-	crr, _ = p.current()
-
-	if crr.Type == lexer.IDENTIFIER {
-		for crr.Type == lexer.IDENTIFIER {
-			args = append(args, &Identifier{crr.Val})
-			p.next()
-			p.next() // skip ',' or ')'
-			crr, _ = p.current()
+	// method definition, 'self' is an implicit first parameter. It is not in the source,
+	// so it has the zero Span
+	var self *Identifier
+	if crr.Type == lexer.COLON {
+		p.next()
+		method := p.name()
+		if method == nil {
+			return nil
 		}
+		id = &MemberExpr{Obj: id, Field: method, Span: p.spanAfter(id)}
+		self = &Identifier{Name: "self"}
 	}
 
-	if crr.Type == lexer.VARAGS {
-		p.next()
-		args = append(args, &Identifier{crr.Val})
+	args, signature, block, ok := p.functionBody()
+	if !ok {
+		return nil
 	}
-	crr, _ = p.current()
-	if crr.Type == lexer.RPAR {
-		p.next() // skip ')'
+	if self != nil {
+		args.Args = append([]Node{self}, args.Args...)
+		if len(signature.ParamTypes) > 0 {
+			signature.ParamTypes = append([]Node{nil}, signature.ParamTypes...)
+		}
 	}
 
-	//parse body
-	block := p.block()
-	crr, _ = p.current()
-	if crr.Type != lexer.END {
+	return &NamedFunction{FunctionName: id, Parameters: args, Body: block, IsMethod: self != nil, TypeSignature: signature, Span: p.spanFrom(start)}
+}
+
+// numeric and generic for
+func (p *Parser) forStatement() Node {
+	start := p.mark()
+	p.next() // 'for'
+	names := p.nameList()
+	if names == nil {
+		return nil
+	}
+
+	crr, _ := p.current()
+	if len(names) == 1 && crr.Type == lexer.ASSIGN {
+		p.next()
+		return p.numericFor(start, names[0].(*Identifier))
+	}
+	if crr.Type != lexer.IN {
+		if len(names) == 1 {
+			p.errorExpected("", lexer.ASSIGN, lexer.IN)
+		} else {
+			p.errorExpected("", lexer.IN)
+		}
 		return nil
 	}
 	p.next()
 
-	return &NamedFunction{id, args, block}
+	exprs := p.exprList()
+	if len(exprs) == 0 {
+		p.errorExpected("expression")
+		return nil
+	}
+	block, ok := p.loopBody()
+	if !ok {
+		return nil
+	}
+	return &ForInStmnt{Names: names, Exprs: exprs, Block: block, Span: p.spanFrom(start)}
 }
 
-// only regular for
-func (p *Parser) forStatement() Node {
-	p.next() // 'for'
-	init := p.assignmentStatement()
-	p.next() // 'do'
-	block := p.block()
-	p.next() // 'end'
+func (p *Parser) numericFor(start mark, variable *Identifier) Node {
+	init := p.expression()
+	if !p.expect(lexer.COMMA) {
+		return nil
+	}
+	limit := p.expression()
 
-	expr, ok := init.(*AssignmentExpr)
-	if ok && len(expr.Exprs) > 2 {
-		return &ForStmnt{expr.Exprs[0], expr.Exprs[1], expr.Exprs[2], block}
+	var step Node
+	crr, _ := p.current()
+	if crr.Type == lexer.COMMA {
+		p.next()
+		step = p.expression()
 	}
-	return &ForStmnt{expr.Exprs[0], expr.Exprs[1], nil, block}
 
+	block, ok := p.loopBody()
+	if !ok {
+		return nil
+	}
+	return &NumericForStmnt{Var: variable, Init: init, Limit: limit, Step: step, Block: block, Span: p.spanFrom(start)}
 }
+
+// loopBody parses 'do' block 'end'
+func (p *Parser) loopBody() ([]Node, bool) {
+	if !p.expect(lexer.DO) {
+		return nil, false
+	}
+	block := p.block()
+	if !p.expect(lexer.END) {
+		return nil, false
+	}
+	return block, true
+}
+
 func (p *Parser) ifStatement() Node {
 	clauses := make([]Node, 0, 3)
+	start := p.mark()
 	p.next() // 'if'
-	expr := p.parseExpression()
-	p.next() // 'then'
-	block := p.block()
-	clauses = append(clauses, &IfClause{expr, block})
-
-	crr, err := p.current()
-	if err != nil {
+	expr := p.expression()
+	if !p.expect(lexer.THEN) {
 		return nil
 	}
+	block := p.block()
+	clause := &IfClause{Condition: expr, Block: block, Span: p.spanFrom(start)}
+	p.attachInner(clause, start)
+	clauses = append(clauses, clause)
+
+	crr, _ := p.current()
 	for crr.Type == lexer.ELSEIF {
+		clauseStart := p.mark()
 		p.next() // 'elseif'
-		expr := p.parseExpression()
-		p.next() // 'then'
+		expr := p.expression()
+		if !p.expect(lexer.THEN) {
+			return nil
+		}
 		block := p.block()
-		clauses = append(clauses, &ElseIfClause{expr, block})
-		crr, err = p.current()
+		clause := &ElseIfClause{Condition: expr, Block: block, Span: p.spanFrom(clauseStart)}
+		p.attachInner(clause, clauseStart)
+		clauses = append(clauses, clause)
+		crr, _ = p.current()
 	}
 
 	if crr.Type == lexer.ELSE {
+		clauseStart := p.mark()
 		p.next() // 'else'
 		block := p.block()
-		p.next() // 'end'
-		clauses = append(clauses, &ElseClause{block})
+		clause := &ElseClause{Block: block, Span: p.spanFrom(clauseStart)}
+		p.attachInner(clause, clauseStart)
+		clauses = append(clauses, clause)
 	}
 
-	crr, err = p.current()
-	if crr.Type == lexer.END {
-		p.next()
+	if !p.expect(lexer.END) {
+		return nil
 	}
 
-	return &IfStmnt{ArgList(clauses)}
+	return &IfStmnt{Clauses: &ArgList{Args: clauses, Span: listSpan(clauses)}, Span: p.spanFrom(start)}
 }
 
 func (p *Parser) repeatStatement() Node {
+	start := p.mark()
 	p.next()
 	block := p.block()
-	p.next() // 'until'
-	cond := p.parseExpression()
-	return &RepeatStmnt{cond, block}
+	if !p.expect(lexer.UNTIL) {
+		return nil
+	}
+	cond := p.expression()
+	return &RepeatStmnt{Condition: cond, Block: block, Span: p.spanFrom(start)}
 }
 
 func (p *Parser) whileStatement() Node {
+	start := p.mark()
 	p.next()
-	cond := p.parseExpression()
-	p.next() // 'do'
+	cond := p.expression()
+	if !p.expect(lexer.DO) {
+		return nil
+	}
 	block := p.block()
-	p.next() // 'end'
-	return &WhileStmnt{cond, block}
+	if !p.expect(lexer.END) {
+		return nil
+	}
+	return &WhileStmnt{Condition: cond, Block: block, Span: p.spanFrom(start)}
 }
 
 func (p *Parser) doStatement() Node {
+	start := p.mark()
 	p.next()
 	block := p.block()
-	p.next() // 'end'
-	return &DoStmnt{block}
-}
-
-func (p *Parser) block() []Node {
-	statements := make([]Node, 0, 10)
-	statement := p.statement()
-	for statement != nil {
-		statements = append(statements, statement)
-		statement = p.statement()
-	}
-
-	return statements
-}
-
-func (p *Parser) functionExpr() Node {
-	crr, err := p.current()
-	if err != nil {
+	if !p.expect(lexer.END) {
 		return nil
 	}
+	return &DoStmnt{Block: block, Span: p.spanFrom(start)}
+}
 
-	if crr.Type != lexer.FUNCTION {
-		return nil
-	}
+func (p *Parser) gotoStatement() Node {
+	start := p.mark()
 	p.next()
-	crr, err = p.current()
-	if crr.Type != lexer.LPAR {
+	label := p.name()
+	if label == nil {
 		return nil
 	}
+	stmnt := &GotoStmnt{Label: label, Span: p.spanFrom(start)}
+	scope := p.scopes[len(p.scopes)-1]
+	scope.gotos = append(scope.gotos, pendingGoto{stmnt, len(scope.locals)})
+	return stmnt
+}
 
+func (p *Parser) labelStatement() Node {
+	start := p.mark()
 	p.next()
-	crr, _ = p.current()
-	var args []Node
-
-	if crr.Type == lexer.IDENTIFIER {
-		for crr.Type == lexer.IDENTIFIER {
-			args = append(args, &Identifier{crr.Val})
-			p.next()
-			p.next() // skip ',' or ')'
-			crr, _ = p.current()
-		}
-	}
-
-	if crr.Type == lexer.VARAGS {
-		p.next()
-		args = append(args, &Identifier{crr.Val})
+	name := p.name()
+	if name == nil || !p.expect(lexer.DBCOLON) {
+		return nil
 	}
-
-	crr, _ = p.current()
-	if crr.Type == lexer.RPAR {
-		p.next() // skip ')'
+	stmnt := &LabelStmnt{Name: name, Span: p.spanFrom(start)}
+	if p.visibleLabel(name.Name) != nil {
+		p.errs = append(p.errs, &NameError{Pos: name.Start, Name: name.Name, Msg: "duplicate label"})
 	}
+	scope := p.scopes[len(p.scopes)-1]
+	label := &blockLabel{stmnt, len(scope.locals)}
+	scope.labels[name.Name] = label
+	scope.trailing = append(scope.trailing, label)
+	return stmnt
+}
 
-	//parse body
-	block := p.block()
-	crr, _ = p.current()
-	if crr.Type != lexer.END {
-		return nil
+// visibleLabel looks the label up in the enclosing blocks of the current function
+func (p *Parser) visibleLabel(name string) *LabelStmnt {
+	for i := len(p.scopes) - 1; i >= 0; i-- {
+		if label, ok := p.scopes[i].labels[name]; ok {
+			return label.LabelStmnt
+		}
+		if p.scopes[i].function {
+			break
+		}
 	}
-	p.next()
+	return nil
+}
 
-	return &Function{ArgList(args), block}
+// declare adds a local to the block being parsed
+func (p *Parser) declare(name *Identifier) {
+	scope := p.scopes[len(p.scopes)-1]
+	scope.locals = append(scope.locals, name.Name)
 }
 
-// and prefix expr at the same time
-func (p *Parser) functionCall() Node {
-	_, err := p.current()
-	if err != nil {
-		return nil
-	}
+func (p *Parser) openScope(function bool) {
+	p.scopes = append(p.scopes, &labelScope{labels: map[string]*blockLabel{}, function: function})
+}
 
-	callee := p.varOrExpr()
-	if callee == nil {
-		return nil
+// closeScope matches the pending gotos against the labels of the block being closed.
+// A goto may jump to a label anywhere in an enclosing block, so the unmatched ones
+// move to the enclosing scope until the function ends. A goto must not jump forward
+// into the scope of a local, but the labels at the end of a block are outside the scope
+// of its locals, unless 'until' follows them as its condition still sees the locals
+func (p *Parser) closeScope() {
+	scope := p.scopes[len(p.scopes)-1]
+	p.scopes = p.scopes[:len(p.scopes)-1]
+	if crr, _ := p.current(); crr.Type != lexer.UNTIL {
+		for _, label := range scope.trailing {
+			label.locals = 0
+		}
 	}
-	args := p.parseNameAndArgs()
-	for args != nil {
-		callee = &CallExpr{callee, args}
-		args = p.parseNameAndArgs()
+	for _, stmnt := range scope.gotos {
+		if label, ok := scope.labels[stmnt.Label.Name]; ok {
+			if stmnt.locals < label.locals {
+				local := scope.locals[stmnt.locals]
+				p.errs = append(p.errs, &NameError{Pos: stmnt.Label.Start, Name: local, Msg: "goto " + stmnt.Label.Name + " jumps into the scope of local"})
+			}
+			continue
+		}
+		if !scope.function {
+			parent := p.scopes[len(p.scopes)-1]
+			parent.gotos = append(parent.gotos, pendingGoto{stmnt.GotoStmnt, len(parent.locals)})
+			continue
+		}
+		// after an unrecovered syntax error the label may be in the part that was not parsed
+		if p.panicking && !p.recovery {
+			continue
+		}
+		p.errs = append(p.errs, &NameError{Pos: stmnt.Label.Start, Name: stmnt.Label.Name, Msg: "no visible label"})
 	}
-	return callee
 }
 
-func (p *Parser) varSuffix(pref Node) Node {
-	crr, err := p.current()
-	if err != nil {
-		return nil
-	}
-
-	arg := p.parseNameAndArgs()
-	callExpr := arg
+func (p *Parser) block() []Node {
+	p.openScope(false)
+	statements := p.statementList()
+	p.closeScope()
+	return statements
+}
 
-	if arg != nil {
-		arg = p.parseNameAndArgs()
-		for arg != nil {
-			callExpr = &CallExpr{callExpr, arg}
-			arg = p.parseNameAndArgs()
+func (p *Parser) statementList() []Node {
+	statements := make([]Node, 0, 10)
+	for {
+		p.skipSemicolons()
+		start, errN := p.mark(), len(p.errs)
+		statement := p.statement()
+		// the labels before another statement are not at the end of the block
+		if _, ok := statement.(*LabelStmnt); !ok && statement != nil {
+			p.scopes[len(p.scopes)-1].trailing = nil
 		}
-	}
 
-	crr, err = p.current()
-	if err == nil && crr.Type == lexer.LBRACE {
-		p.next()
-		expr := p.parseExpression()
-		p.next() // ']'
-		if callExpr == nil {
-			return &IndexExpr{pref, expr}
+		crr, err := p.current()
+		if statement == nil && err == nil && !blockFollow(crr.Type) {
+			p.errorExpected("statement")
 		}
-		return &IndexExpr{callExpr, expr}
-	} else if err == nil && crr.Type == lexer.DOT {
-		p.next()
-		crr, err = p.current()
-		if crr.Type != lexer.IDENTIFIER {
-			panic(fmt.Errorf("Expected identifier, but received %o", crr.Type))
+		if p.panicking && p.recovery {
+			errNode := p.synchronize(start, errN)
+			p.attachComments(errNode, start)
+			statements = append(statements, errNode)
+			continue
 		}
-		p.next()
-		if callExpr == nil {
-			return &MemberExpr{pref, &Identifier{crr.Val}}
+		// a statement cut short by the error is left out
+		if statement == nil || p.panicking {
+			break
 		}
-		return &MemberExpr{callExpr, &Identifier{crr.Val}}
+		p.attachComments(statement, start)
+		statements = append(statements, statement)
 	}
 
-	return nil
+	return statements
 }
 
-func (p *Parser) parseVar() Node {
+func (p *Parser) skipSemicolons() {
 	crr, err := p.current()
-	if err != nil {
-		return nil
+	for err == nil && crr.Type == lexer.SEMICOLON {
+		p.next()
+		crr, err = p.current()
 	}
+}
 
-	var varExpr Node
+// functionBody parses ['<' TypeParams '>'] '(' [parlist] ')' [':' ReturnType] block 'end',
+// the type parameters and the annotations of the parameters and the returns are Luau only
+func (p *Parser) functionBody() (*ArgList, TypeSignature, []Node, bool) {
+	var signature TypeSignature
+	crr, _ := p.current()
+	if crr.Type == lexer.LESSER && p.dialect.HasTypes() {
+		if signature.TypeParams = p.typeParams(); signature.TypeParams == nil {
+			return nil, signature, nil, false
+		}
+	}
+	paramsStart := p.mark()
+	if !p.expect(lexer.LPAR) {
+		return nil, signature, nil, false
+	}
 
-	if crr.Type == lexer.IDENTIFIER {
-		p.next()
-		varExpr = &Identifier{crr.Val}
-		crrI := p.i
-		suff := p.varSuffix(varExpr)
-		if suff == nil {
-			p.i = crrI
-			return varExpr
+	var args, types []Node
+	crr, _ = p.current()
+	for crr.Type != lexer.RPAR {
+		if crr.Type == lexer.VARAGS {
+			args = append(args, &Identifier{Name: crr.Val, Span: tokenSpan(crr)})
+			p.next()
+			types = append(types, p.typeAnnotation())
+			break
 		}
-		varExpr = suff
-		crrI = p.i
-		suff = p.varSuffix(varExpr)
-		if suff != nil {
-			for suff != nil {
-				varExpr = &CallExpr{varExpr, suff}
-				suff = p.varSuffix(varExpr)
-			}
-			return varExpr
+		if crr.Type != lexer.IDENTIFIER {
+			p.errorExpected("", lexer.IDENTIFIER, lexer.VARAGS)
+			return nil, signature, nil, false
 		}
-		p.i = crrI
-		return varExpr
-
-	} else if crr.Type == lexer.LPAR {
+		args = append(args, &Identifier{Name: crr.Val, Span: tokenSpan(crr)})
 		p.next()
-		varExpr = p.parseExpression()
-		p.next() // ')'
-		crrI := p.i
-		suff := p.varSuffix(varExpr)
+		types = append(types, p.typeAnnotation())
 
-		if suff == nil {
-			p.i = crrI
-			return varExpr
+		crr, _ = p.current()
+		if crr.Type != lexer.COMMA {
+			break
 		}
-
-		varExpr = suff
-		crrI = p.i
-		suff = p.varSuffix(varExpr)
-		if suff != nil {
-			for suff != nil {
-				varExpr = &CallExpr{varExpr, suff}
-				suff = p.varSuffix(varExpr)
-			}
-			return varExpr
+		p.next()
+		crr, _ = p.current()
+	}
+	if !p.expect(lexer.RPAR) {
+		return nil, signature, nil, false
+	}
+	params := &ArgList{Args: args, Span: p.spanFrom(paramsStart)}
+	p.attachInner(params, paramsStart)
+	if AnyType(types) {
+		signature.ParamTypes = types
+	}
+	crr, _ = p.current()
+	if crr.Type == lexer.COLON && p.dialect.HasTypes() {
+		p.next()
+		if signature.ReturnTypes = p.returnType(); signature.ReturnTypes == nil {
+			return nil, signature, nil, false
 		}
-		p.i = crrI
-		return varExpr
 	}
 
-	return nil
+	p.openScope(true)
+	block := p.statementList()
+	p.closeScope()
+	if !p.expect(lexer.END) {
+		return nil, signature, nil, false
+	}
+	return params, signature, block, true
 }
 
-func (p *Parser) varOrExpr() Node {
+func (p *Parser) functionExpr() Node {
 	crr, err := p.current()
-
 	if err != nil {
 		return nil
 	}
 
-	if termExpr(crr.Type) {
-		p.next()
-		return &SimpleExpr{crr.Type, crr.Val}
+	if crr.Type != lexer.FUNCTION {
+		return nil
 	}
-
-	expr := p.parseVar()
-	if expr != nil {
-		return expr
+	start := p.mark()
+	p.next()
+	args, signature, block, ok := p.functionBody()
+	if !ok {
+		return nil
 	}
 
-	return expr
+	function := &Function{Parameters: args, Body: block, TypeSignature: signature, Span: p.spanFrom(start)}
+	p.attachInner(function, start)
+	return function
 }
 
-func (p *Parser) parseProdExpr() Node {
+// primaryExpr parses Id | '(' expr ')'
+func (p *Parser) primaryExpr() Node {
 	crr, err := p.current()
+	if err != nil {
+		return nil
+	}
 
-	if err == nil && unOp(crr.Type) {
+	switch crr.Type {
+	case lexer.IDENTIFIER:
 		p.next()
-		expr := p.varOrExpr()
-		return &UnaryExpr{crr.Type, expr}
+		return &Identifier{Name: crr.Val, Span: tokenSpan(crr)}
+	case lexer.LPAR:
+		start := p.mark()
+		p.next()
+		expr := p.expression()
+		if !p.expect(lexer.RPAR) {
+			return nil
+		}
+		paren := &ParenExpr{Expr: expr, Span: p.spanFrom(start)}
+		p.attachInner(paren, start)
+		return paren
 	}
-	return p.varOrExpr()
+	return nil
 }
 
-func (p *Parser) parseSumExpr() Node {
+// suffixedExpr parses primaryExpr { '.' Id | '[' expr ']' | ':' Id args | args }
+func (p *Parser) suffixedExpr() Node {
+	start := p.mark()
+	expr := p.primaryExpr()
+	if expr == nil {
+		return nil
+	}
 
-	left := p.parseProdExpr()
+	for {
+		crr, err := p.current()
+		if err != nil {
+			return expr
+		}
 
-	crr, err := p.current()
-	for err == nil && prodOp(crr.Type) {
-		p.next()
-		expr := p.parseProdExpr()
-		left = &BinExpr{crr.Type, left, expr}
-		crr, err = p.current()
+		switch crr.Type {
+		case lexer.DOT:
+			p.next()
+			field := p.name()
+			if field == nil {
+				return nil
+			}
+			expr = &MemberExpr{Obj: expr, Field: field, Span: p.spanFrom(start)}
+			p.attachInner(expr, start)
+		case lexer.LBRACE:
+			p.next()
+			index := p.expression()
+			if !p.expect(lexer.RBRACE) {
+				return nil
+			}
+			expr = &IndexExpr{Base: expr, ExprIndex: index, Span: p.spanFrom(start)}
+			p.attachInner(expr, start)
+		case lexer.COLON:
+			p.next()
+			method := p.name()
+			if method == nil {
+				return nil
+			}
+			args := p.parseNameAndArgs()
+			if args == nil {
+				p.errorExpected("function arguments")
+				return nil
+			}
+			expr = &MethodCallExpr{Receiver: expr, Method: method, Arguments: args, Span: p.spanFrom(start)}
+			p.attachInner(expr, start)
+		default:
+			args := p.parseNameAndArgs()
+			if args == nil {
+				return expr
+			}
+			expr = &CallExpr{Base: expr, Arguments: args, Span: p.spanFrom(start)}
+			p.attachInner(expr, start)
+		}
 	}
-
-	return left
 }
 
-func (p *Parser) parseRelExpr() Node {
-
-	left := p.parseSumExpr()
-
+// name parses an identifier
+func (p *Parser) name() *Identifier {
 	crr, err := p.current()
-	for err == nil && sumOp(crr.Type) {
-		p.next()
-		expr := p.parseSumExpr()
-		left = &BinExpr{crr.Type, left, expr}
-		crr, err = p.current()
+	if err != nil || crr.Type != lexer.IDENTIFIER {
+		p.errorExpected("", lexer.IDENTIFIER)
+		return nil
 	}
-
-	return left
+	p.next()
+	return &Identifier{Name: crr.Val, Span: tokenSpan(crr)}
 }
 
-func (p *Parser) parseAndExpr() Node {
-
-	left := p.parseRelExpr()
-
+// simpleExpr parses termExpr | tableConstructor | funcExpr | suffixedExpr
+func (p *Parser) simpleExpr() Node {
 	crr, err := p.current()
-	for err == nil && relOp(crr.Type) {
-		p.next()
-		expr := p.parseRelExpr()
-		left = &BinExpr{crr.Type, left, expr}
-		crr, err = p.current()
+	if err != nil {
+		return nil
 	}
 
-	return left
+	switch {
+	case crr.Type == lexer.NUMBER:
+		p.next()
+		return &NumberLiteral{Raw: crr.Val, Number: crr.Num, Span: tokenSpan(crr)}
+	case termExpr(crr.Type):
+		p.next()
+		return &SimpleExpr{Type: crr.Type, Val: crr.Val, Raw: crr.Raw, Span: tokenSpan(crr)}
+	case crr.Type == lexer.LCBRACE:
+		return p.parseTableConstructor()
+	case crr.Type == lexer.FUNCTION:
+		return p.functionExpr()
+	case crr.Type == lexer.IF && p.dialect.HasTypes():
+		return p.ifExpr()
+	}
+	return p.suffixedExpr()
 }
 
-func (p *Parser) parseOrExpr() Node {
-
-	left := p.parseAndExpr()
+// subExpr parses a chain of binary operators that bind tighter than limit
+func (p *Parser) subExpr(limit int) Node {
+	var left Node
 
+	start := p.mark()
 	crr, err := p.current()
-	for err == nil && crr.Type == lexer.AND {
+	if op, ok := unOp(crr.Type); err == nil && ok {
 		p.next()
-		expr := p.parseAndExpr()
-		left = &BinExpr{crr.Type, left, expr}
-		crr, err = p.current()
+		operand := p.subExpr(unaryPriority)
+		if operand == nil {
+			p.errorExpected("expression")
+			return nil
+		}
+		left = &UnaryExpr{Op: op, Operand: operand, Span: p.spanFrom(start)}
+		p.attachInner(left, start)
+	} else {
+		left = p.typeAssertion(p.simpleExpr(), start)
+		if left == nil {
+			return nil
+		}
 	}
 
-	return left
-}
-
-func (p *Parser) parseBinExpr() Node {
-
-	left := p.parseOrExpr()
-	crr, err := p.current()
-	for err == nil && crr.Type == lexer.OR {
+	crr, err = p.current()
+	for err == nil {
+		prio, ok := p.binaryOp(crr.Type)
+		if !ok || prio.left <= limit {
+			break
+		}
 		p.next()
-		expr := p.parseOrExpr()
-		left = &BinExpr{crr.Type, left, expr}
+		right := p.subExpr(prio.right)
+		if right == nil {
+			p.errorExpected("expression")
+			return nil
+		}
+		left = &BinExpr{Op: crr.Type, Left: left, Right: right, Span: p.spanFrom(start)}
+		p.attachInner(left, start)
 		crr, err = p.current()
 	}
 
@@ -699,42 +1401,47 @@ func (p *Parser) parseBinExpr() Node {
 }
 
 func (p *Parser) parseExpression() Node {
+	return p.subExpr(0)
+}
 
-	expr := p.functionExpr()
-	if expr != nil {
-		return expr
+// Run builds the AST. Parsing stops at the first syntax error and
+// the statements parsed so far are returned together with the *SyntaxError,
+// unless the parser was created WithRecovery
+func (p *Parser) Run() (Program, []error) {
+	p.openScope(true)
+	if crr, err := p.current(); err == nil && crr.Type == lexer.SHEBANG {
+		p.shebang = crr.Val
+		p.next()
 	}
-
-	crrI := p.i
-	expr = p.parseBinExpr()
-	if expr != nil {
-		crr, _ := p.current()
-		if crr.Type != lexer.LPAR {
-			return expr
+	statements := Program(p.statementList())
+	for {
+		if _, err := p.current(); err != nil {
+			break
 		}
-		p.i = crrI
-	}
-
-	expr = p.parseTableConstructor()
-	if expr != nil {
-		return expr
-	}
-
-	return p.functionCall()
-}
-
-// Run builds the AST
-func (p *Parser) Run() Program {
-	statement := p.statement()
-	statements := make([]Node, 0, 10)
-	for statement != nil {
-		statements = append(statements, statement)
-		if p.i >= len(p.tokens) {
+		// a block terminator without an opening statement, skip just that token
+		start := p.mark()
+		p.errorExpected("statement")
+		if !p.recovery {
 			break
 		}
-		statement = p.statement()
+		p.panicking = false
+		p.next()
+		errNode := &ErrorNode{Err: p.errs[len(p.errs)-1], Span: p.spanFrom(start)}
+		p.attachComments(errNode, start)
+		statements = append(statements, errNode)
+		statements = append(statements, p.statementList()...)
+	}
+	p.closeScope()
+	if !p.panicking {
+		p.attachRest(statements)
 	}
 
 	p.topstatements = statements
-	return statements
+	return statements, p.errs
+}
+
+// Shebang returns the first line of the script skipped by Run as a shebang, like "#!/usr/bin/env lua",
+// or "" when there is none. It is not a statement of the Program
+func (p *Parser) Shebang() string {
+	return p.shebang
 }
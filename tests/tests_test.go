@@ -1,10 +1,17 @@
 package tests_test
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
+	"testing/iotest"
 
 	"../ast2json"
 	ast2jsonipl "../ast2jsonIPL"
@@ -37,7 +44,7 @@ func TestParser(t *testing.T) {
 	lex = lex.New(string(src))
 	tokens, _ := lex.Run()
 	parser := parser.NewParser(tokens)
-	node := parser.Run()
+	node, _ := parser.Run()
 
 	jsonfile, _ := os.Create("test.json")
 	defer file.Close()
@@ -52,7 +59,7 @@ func TestParserIPL(t *testing.T) {
 	lex = lex.New(string(src))
 	tokens, _ := lex.Run()
 	parser := parser.NewParser(tokens)
-	node := parser.Run()
+	node, _ := parser.Run()
 
 	jsonfile, _ := os.Create("testIPL.json")
 	defer file.Close()
@@ -67,10 +74,1453 @@ func TestParserIPL2(t *testing.T) {
 	lex = lex.New(string(src))
 	tokens, _ := lex.Run()
 	parser := parser.NewParser(tokens)
-	node := parser.Run()
+	node, _ := parser.Run()
 
 	jsonfile, _ := os.Create("testIPL2.json")
 	defer file.Close()
 	visitor := ast2jsonipl.NewJSONVisitor(jsonfile)
 	node.AcceptVisitor(visitor)
 }
+
+func TestPositions(t *testing.T) {
+	src := "x = 1\nlocal s = \"ab\" -- c\nprint(s)"
+	var lex lexer.Lexer
+	lex = lex.New(src)
+	tokens, _ := lex.Run()
+
+	str := tokens[6]
+	if str.Type != lexer.STRING || str.Start != (lexer.Position{Line: 2, Col: 11, Offset: 16}) || str.End != (lexer.Position{Line: 2, Col: 15, Offset: 20}) {
+		t.Errorf("unexpected string token %v", str)
+	}
+
+	p := parser.NewParser(tokens)
+	program, _ := p.Run()
+	call := program[2].NodeSpan()
+	if call.Start.Line != 3 || call.Start.Col != 1 || call.End.Offset != len(src) {
+		t.Errorf("unexpected call span %v", call)
+	}
+
+	// the lists cover the keyword and the parentheses, also when empty
+	lex = lex.New("function f()\n  g( )\n  return\nend\nreturn f(1, 2)")
+	tokens, _ = lex.Run()
+	p = parser.NewParser(tokens)
+	program, _ = p.Run()
+	f := program[0].(*parser.NamedFunction)
+	spans := []parser.Span{
+		f.Parameters.NodeSpan(),
+		f.Body[0].(*parser.CallExpr).Arguments.NodeSpan(),
+		f.Body[1].NodeSpan(),
+		program[1].NodeSpan(),
+		program[1].(*parser.ReturnList).Exprs[0].(*parser.CallExpr).Arguments.NodeSpan(),
+	}
+	expected := []string{"1:11-1:13", "2:4-2:7", "3:3-3:9", "5:1-5:15", "5:9-5:15"}
+	for i, span := range spans {
+		if s := fmt.Sprintf("%d:%d-%d:%d", span.Start.Line, span.Start.Col, span.End.Line, span.End.Col); s != expected[i] {
+			t.Errorf("expected span %s, got %s", expected[i], s)
+		}
+	}
+	var buf bytes.Buffer
+	program.AcceptVisitor(ast2json.NewJSONVisitorWithOptions(&buf, ast2json.Options{Locations: true}))
+	if strings.Contains(buf.String(), "\"Line\": 0") {
+		t.Errorf("a node has no location %s", buf.String())
+	}
+}
+
+func TestJSONLocations(t *testing.T) {
+	var lex lexer.Lexer
+	lex = lex.New("a = 10\nb = 2*a")
+	tokens, _ := lex.Run()
+	p := parser.NewParser(tokens)
+	program, _ := p.Run()
+
+	var buf bytes.Buffer
+	program.AcceptVisitor(ast2json.NewJSONVisitorWithOptions(&buf, ast2json.Options{Locations: true}))
+
+	var out struct {
+		Statements []struct {
+			Loc struct {
+				Start struct{ Line, Column, Offset int }
+				End   struct{ Line, Column, Offset int }
+			}
+		}
+	}
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	loc := out.Statements[1].Loc
+	if loc.Start.Line != 2 || loc.Start.Column != 1 || loc.End.Column != 8 || loc.End.Offset != 14 {
+		t.Errorf("unexpected location %+v", loc)
+	}
+}
+
+func TestSyntaxErrors(t *testing.T) {
+	var lex lexer.Lexer
+	lex = lex.New("x = 1\nwhile x do\n  x = x + \nend")
+	tokens, _ := lex.Run()
+	p := parser.NewParser(tokens)
+	program, errs := p.Run()
+
+	if len(program) != 1 || len(errs) != 1 {
+		t.Fatalf("expected 1 statement and 1 error, got %d and %v", len(program), errs)
+	}
+	err, ok := errs[0].(*parser.SyntaxError)
+	if !ok {
+		t.Fatalf("expected *parser.SyntaxError, got %T", errs[0])
+	}
+	if err.Pos.Line != 4 || err.Pos.Col != 1 || err.Found.Type != lexer.END || err.Msg != "expression" {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	lex = lex.New("s = \"abc\nx = 1")
+	_, lexErr := lex.Run()
+	if e, ok := lexErr.(*lexer.Error); !ok || e.Pos.Line != 1 || e.Pos.Col != 5 {
+		t.Errorf("expected unfinished string error, got %v", lexErr)
+	}
+
+	// the source ends right after an operator that may have a second character
+	for _, src := range []string{"x =", "local t = a.", "x = 1 <", "x = 1 >", "t:", "x = 1 ~", "x = 1 /"} {
+		lex = lex.New(src)
+		tokens, err := lex.Run()
+		if err != nil {
+			t.Errorf("%q: unexpected lexer error %v", src, err)
+			continue
+		}
+		if last := tokens[len(tokens)-1]; last.Val != src[len(src)-1:] {
+			t.Errorf("%q: expected the operator last, got %v", src, last)
+		}
+		p := parser.NewParser(tokens)
+		_, errs := p.Run()
+		if len(errs) != 1 {
+			t.Errorf("%q: expected 1 error, got %v", src, errs)
+		} else if err, ok := errs[0].(*parser.SyntaxError); !ok || err.Found.Type != lexer.EOF {
+			t.Errorf("%q: expected a SyntaxError at <eof>, got %v", src, errs[0])
+		}
+	}
+
+	// the statement cut short by the error is not in the program
+	for _, src := range []string{"y = 2\nx = 1,", "y = 2\nlocal a, b = 1,", "y = 2\nt.x, t[1] = f(1,"} {
+		lex = lex.New(src)
+		tokens, _ := lex.Run()
+		p := parser.NewParser(tokens)
+		program, errs := p.Run()
+		if len(program) != 1 || len(errs) != 1 {
+			t.Errorf("%q: expected 1 statement and 1 error, got %d and %v", src, len(program), errs)
+		}
+		var buf, ipl bytes.Buffer
+		program.AcceptVisitor(ast2json.NewJSONVisitor(&buf))
+		program.AcceptVisitor(ast2jsonipl.NewJSONVisitor(&ipl))
+		if !json.Valid(buf.Bytes()) || !json.Valid(ipl.Bytes()) {
+			t.Errorf("%q: invalid JSON %s %s", src, buf.String(), ipl.String())
+		}
+	}
+
+	// return ends its block
+	returns := map[string]string{
+		"return 1 print(2)":                   "1:10: expected end of block after return, found 'print'",
+		"return; x = 1":                       "1:9: expected end of block after return, found 'x'",
+		"return;;":                            "1:8: expected end of block after return, found ';'",
+		"do return 1 local x end":             "1:13: expected end of block after return, found 'local'",
+		"return 1;":                           "",
+		"do return end print(1)":              "",
+		"if a then return 1; else return end": "",
+		"repeat return until a":               "",
+	}
+	for src, expected := range returns {
+		lex = lex.New(src)
+		tokens, _ := lex.Run()
+		p := parser.NewParser(tokens)
+		_, errs := p.Run()
+		if expected == "" && len(errs) != 0 {
+			t.Errorf("%q: unexpected errors %v", src, errs)
+		} else if expected != "" && (len(errs) != 1 || errs[0].Error() != expected) {
+			t.Errorf("%q: expected %s, got %v", src, expected, errs)
+		}
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	src := "a = 1\nb = = 2\nfunction f()\n  c = )\n  return c\nend\nd = 4\nend\ne = 5"
+	var lex lexer.Lexer
+	lex = lex.New(src)
+	tokens, _ := lex.Run()
+	p := parser.NewParser(tokens, parser.WithRecovery())
+	program, errs := p.Run()
+
+	if len(errs) != 3 {
+		t.Fatalf("expected 3 errors, got %v", errs)
+	}
+	if len(program) != 6 {
+		t.Fatalf("expected 6 top level statements, got %d", len(program))
+	}
+	if _, ok := program[1].(*parser.ErrorNode); !ok {
+		t.Errorf("expected ErrorNode, got %T", program[1])
+	}
+	f, ok := program[2].(*parser.NamedFunction)
+	if !ok || len(f.Body) != 2 {
+		t.Fatalf("expected function with 2 statements, got %#v", program[2])
+	}
+	if _, ok := f.Body[0].(*parser.ErrorNode); !ok {
+		t.Errorf("expected ErrorNode in function body, got %T", f.Body[0])
+	}
+	if _, ok := program[4].(*parser.ErrorNode); !ok {
+		t.Errorf("expected ErrorNode for stray end, got %T", program[4])
+	}
+
+	var buf bytes.Buffer
+	program.AcceptVisitor(ast2json.NewJSONVisitor(&buf))
+	if !json.Valid(buf.Bytes()) {
+		t.Errorf("invalid JSON %s", buf.String())
+	}
+
+	// parsing resumes at assignments and calls, not only at keywords
+	tests := []struct {
+		src   string
+		types string
+	}{
+		{"a = = 1\nb = 2\nprint(b)\nc = 3\nlocal d = 4", "[*parser.ErrorNode *parser.AssignmentExpr *parser.CallExpr *parser.AssignmentExpr *parser.LocalAssignmentExpr]"},
+		{"a = = 1 b = 2 t.x = f() g()", "[*parser.ErrorNode *parser.AssignmentExpr *parser.AssignmentExpr *parser.CallExpr]"},
+		{"f(1 2)\n(g or h)()\nx = {]\ny = x", "[*parser.ErrorNode *parser.CallExpr *parser.ErrorNode *parser.AssignmentExpr]"},
+	}
+	for _, test := range tests {
+		lex = lex.New(test.src)
+		tokens, _ := lex.Run()
+		p := parser.NewParser(tokens, parser.WithRecovery())
+		program, _ := p.Run()
+		types := make([]string, len(program))
+		for i, statement := range program {
+			types[i] = fmt.Sprintf("%T", statement)
+		}
+		if fmt.Sprint(types) != test.types {
+			t.Errorf("%q: expected %s, got %v", test.src, test.types, types)
+		}
+	}
+}
+
+func TestForLoops(t *testing.T) {
+	var lex lexer.Lexer
+	lex = lex.New("for k, v in pairs(t) do print(k, v) end\nfor i = 10, 1, 2 do end")
+	tokens, _ := lex.Run()
+	p := parser.NewParser(tokens)
+	program, errs := p.Run()
+	if len(errs) != 0 || len(program) != 2 {
+		t.Fatalf("unexpected result %v %v", program, errs)
+	}
+
+	forIn, ok := program[0].(*parser.ForInStmnt)
+	if !ok || len(forIn.Names) != 2 || len(forIn.Exprs) != 1 || len(forIn.Block) != 1 {
+		t.Errorf("unexpected for-in %#v", program[0])
+	}
+	numeric, ok := program[1].(*parser.NumericForStmnt)
+	if !ok || numeric.Var.Name != "i" || numeric.Step == nil {
+		t.Errorf("unexpected numeric for %#v", program[1])
+	}
+}
+
+func TestMethods(t *testing.T) {
+	var lex lexer.Lexer
+	lex = lex.New("function Dog:new(name) return self end\nmrDog = Dog:new('rex')\nmrDog:bark { loud = true }")
+	tokens, _ := lex.Run()
+	p := parser.NewParser(tokens)
+	program, errs := p.Run()
+	if len(errs) != 0 || len(program) != 3 {
+		t.Fatalf("unexpected result %v %v", program, errs)
+	}
+
+	f, ok := program[0].(*parser.NamedFunction)
+	if !ok || !f.IsMethod || len(f.Parameters.Args) != 2 || f.Parameters.Args[0].(*parser.Identifier).Name != "self" {
+		t.Errorf("unexpected method definition %#v", program[0])
+	} else if span := f.Parameters.Args[0].NodeSpan(); span != (parser.Span{}) {
+		t.Errorf("expected the zero span for the implicit self, got %+v", span)
+	}
+	assignment := program[1].(*parser.AssignmentExpr)
+	if call, ok := assignment.Exprs[0].(*parser.MethodCallExpr); !ok || call.Method.Name != "new" {
+		t.Errorf("unexpected method call %#v", assignment.Exprs[0])
+	}
+	if call, ok := program[2].(*parser.MethodCallExpr); !ok || call.Method.Name != "bark" {
+		t.Errorf("unexpected method call statement %#v", program[2])
+	}
+}
+
+func TestGoto(t *testing.T) {
+	tests := []struct {
+		src  string
+		errs []string
+	}{
+		{"while true do\n  if x then goto continue end\n  ::continue::\nend", nil},
+		{"goto done\nx = 1\n::done::", nil},
+		{"do ::top:: end\ngoto top", []string{"2:6: no visible label 'top'"}},
+		{"::a:: do ::a:: end", []string{"1:12: duplicate label 'a'"}},
+		{"::out::\nf = function() goto out end", []string{"2:21: no visible label 'out'"}},
+		{"goto x; local a = 1 ::x:: print(a)", []string{"1:6: goto x jumps into the scope of local 'a'"}},
+		{"do goto x end local a, b ::x:: print(a)", []string{"1:9: goto x jumps into the scope of local 'a'"}},
+		{"local a goto x local b ::x:: print(b)", []string{"1:14: goto x jumps into the scope of local 'b'"}},
+		{"repeat goto x; local a ::x:: until a", []string{"1:13: goto x jumps into the scope of local 'a'"}},
+		{"local function f() end goto x local function g() end ::x:: g()", []string{"1:29: goto x jumps into the scope of local 'g'"}},
+		// a label at the end of a block is outside the scope of its locals
+		{"do goto x; local a = 1 ::x:: end", nil},
+		{"while a do goto x; local b ::x:: ; ::y:: end", nil},
+		{"goto x; local a = 1 ::x::", nil},
+		{"::x:: local a goto x", nil},
+	}
+	for _, test := range tests {
+		var lex lexer.Lexer
+		lex = lex.New(test.src)
+		tokens, _ := lex.Run()
+		p := parser.NewParser(tokens)
+		_, errs := p.Run()
+		if len(errs) != len(test.errs) {
+			t.Errorf("%q: expected errors %v, got %v", test.src, test.errs, errs)
+			continue
+		}
+		for i := range errs {
+			if errs[i].Error() != test.errs[i] {
+				t.Errorf("%q: expected error %q, got %q", test.src, test.errs[i], errs[i].Error())
+			}
+		}
+	}
+
+	var lex lexer.Lexer
+	lex = lex.New("goto done ::done::")
+	tokens, _ := lex.Run()
+	p := parser.NewParser(tokens)
+	program, _ := p.Run()
+	if g, ok := program[0].(*parser.GotoStmnt); !ok || g.Label.Name != "done" {
+		t.Errorf("unexpected goto %#v", program[0])
+	}
+	if l, ok := program[1].(*parser.LabelStmnt); !ok || l.Name.Name != "done" {
+		t.Errorf("unexpected label %#v", program[1])
+	}
+}
+
+func TestLocalAttributes(t *testing.T) {
+	var lex lexer.Lexer
+	lex = lex.New("local x <const>, y = 5\nlocal f <close> = io.open(name)\nlocal z <static> = 1")
+	tokens, _ := lex.Run()
+	p := parser.NewParser(tokens)
+	program, errs := p.Run()
+	if len(program) != 3 {
+		t.Fatalf("expected 3 statements, got %d", len(program))
+	}
+	if len(errs) != 1 || errs[0].Error() != "3:10: unknown attribute 'static'" {
+		t.Errorf("unexpected errors %v", errs)
+	}
+	lex = lex.New("local a <close>, b <const>, c <close> = f()")
+	tokens, _ = lex.Run()
+	p = parser.NewParser(tokens)
+	if _, errs := p.Run(); len(errs) != 1 || errs[0].Error() != "1:32: multiple to-be-closed variables in local list 'close'" {
+		t.Errorf("expected an error on the second <close>, got %v", errs)
+	}
+	local := program[0].(*parser.LocalAssignmentExpr)
+	if len(local.Attribs) != 2 || local.Attribs[0] != "const" || local.Attribs[1] != "" {
+		t.Errorf("unexpected attributes %q", local.Attribs)
+	}
+
+	var buf bytes.Buffer
+	program[:2].AcceptVisitor(ast2json.NewJSONVisitor(&buf))
+	var out struct {
+		Statements []struct {
+			Attributes []*string
+		}
+	}
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	attribs := out.Statements[0].Attributes
+	if len(attribs) != 2 || *attribs[0] != "const" || attribs[1] != nil || *out.Statements[1].Attributes[0] != "close" {
+		t.Errorf("unexpected JSON %s", buf.String())
+	}
+}
+
+func TestDialects(t *testing.T) {
+	tests := []struct {
+		dialect lexer.Dialect
+		src     string
+		err     string
+	}{
+		{lexer.Lua54, "local x <const> = a // b & c", ""},
+		{lexer.Lua53, "x = a >> 2 ~ b", ""},
+		{lexer.Lua53, "local x <const> = 1", "1:10: Lua 5.3 does not support the attribute 'const'"},
+		{lexer.Lua52, "x = a // b", "1:7: '//' is not supported by Lua 5.2"},
+		{lexer.Lua52, "goto done ::done::", ""},
+		{lexer.Lua52, "s = 'a\\z\n   b'", ""},
+		{lexer.Lua51, "s = 'a\\z b'", "1:7: escape '\\z' is not supported by Lua 5.1"},
+		{lexer.Lua51, "s = '\\x41'", "1:6: escape '\\x' is not supported by Lua 5.1"},
+		{lexer.Lua52, "s = '\\x41'", ""},
+		{lexer.LuaJIT, "s = '\\x41\\u{48}'", ""},
+		{lexer.Lua51, "s = '\\u{48}'", "1:6: escape '\\u' is not supported by Lua 5.1"},
+		{lexer.Lua52, "s = 'a\\u{48}'", "1:7: escape '\\u' is not supported by Lua 5.2"},
+		{lexer.Lua53, "s = '\\u{48}'", ""},
+		{lexer.Lua53, "s = '\\u{10FFFF}'", ""},
+		{lexer.Lua53, "s = '\\u{110000}'", "1:6: UTF-8 value too large"},
+		{lexer.LuaJIT, "s = '\\u{110000}'", "1:6: UTF-8 value too large"},
+		{lexer.Luau, "s = '\\u{110000}'", "1:6: UTF-8 value too large"},
+		{lexer.Lua54, "s = '\\u{7FFFFFFF}'", ""},
+		{lexer.Lua54, "s = '\\u{80000000}'", "1:6: UTF-8 value too large"},
+		{lexer.Lua51, "::done::", "1:1: '::' is not supported by Lua 5.1"},
+		{lexer.Lua51, "goto = 1", ""},
+		{lexer.Lua51, "x = ~a", "1:5: '~' is not supported by Lua 5.1"},
+		{lexer.LuaJIT, "x = 1ULL + 0x10ll + 2i + 1.5i", ""},
+		{lexer.LuaJIT, "x = a | b", "1:7: '|' is not supported by LuaJIT"},
+		{lexer.Lua54, "x = 10LL", "1:7: number suffix 'LL' is not supported by Lua 5.4"},
+	}
+	for _, test := range tests {
+		var lex lexer.Lexer
+		lex = lex.New(test.src, lexer.WithDialect(test.dialect))
+		tokens, err := lex.Run()
+		if err == nil {
+			p := parser.NewParser(tokens, parser.WithDialect(test.dialect))
+			if _, errs := p.Run(); len(errs) > 0 {
+				err = errs[0]
+			}
+		}
+		if (err == nil && test.err != "") || (err != nil && err.Error() != test.err) {
+			t.Errorf("%s %q: expected error %q, got %v", test.dialect, test.src, test.err, err)
+		}
+	}
+}
+
+func TestLuau(t *testing.T) {
+	src := `export type Map<K, V> = {[K]: V, size: number?}
+type Callback = (err: string | nil, ...any) -> ()
+local count: number, name = 0, "n"
+local function find<T>(list: {T}, pred: (T) -> boolean): (T?, number)
+	for i, v in ipairs(list) do
+		if not pred(v) then continue end
+		return v, i
+	end
+	return nil, 0
+end
+count += 1
+name ..= "!"
+local sign = if count > 0 then 1 elseif count < 0 then -1 else 0
+local nested: Array<Array<number>> = (data :: any).rows
+print(type(count), typeof(count))`
+
+	var lex lexer.Lexer
+	lex = lex.New(src, lexer.WithDialect(lexer.Luau))
+	tokens, err := lex.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := parser.NewParser(tokens, parser.WithDialect(lexer.Luau))
+	program, errs := p.Run()
+	if len(errs) != 0 || len(program) != 9 {
+		t.Fatalf("unexpected result %d statements %v", len(program), errs)
+	}
+
+	decl, ok := program[0].(*parser.TypeDecl)
+	if !ok || !decl.Export || decl.Name.Name != "Map" || len(decl.TypeParams) != 2 {
+		t.Errorf("unexpected type declaration %#v", program[0])
+	} else if table, ok := decl.Type.(*parser.TableType); !ok || len(table.Fields) != 2 {
+		t.Errorf("unexpected table type %#v", decl.Type)
+	}
+	callback := program[1].(*parser.TypeDecl)
+	if fn, ok := callback.Type.(*parser.FunctionType); !ok || len(fn.Params) != 2 || len(fn.Returns) != 0 {
+		t.Errorf("unexpected function type %#v", callback.Type)
+	}
+	local := program[2].(*parser.LocalAssignmentExpr)
+	if len(local.Types) != 2 || local.Types[0].(*parser.NamedType).Name.Name != "number" || local.Types[1] != nil {
+		t.Errorf("unexpected local types %#v", local.Types)
+	}
+	find := program[3].(*parser.LocalFunction)
+	if len(find.TypeParams) != 1 || len(find.ParamTypes) != 2 || len(find.ReturnTypes) != 2 {
+		t.Errorf("unexpected signature %#v", find.TypeSignature)
+	}
+	loop := find.Body[0].(*parser.ForInStmnt)
+	clause := loop.Block[0].(*parser.IfStmnt).Clauses.(*parser.ArgList).Args[0].(*parser.IfClause)
+	if _, ok := clause.Block[0].(*parser.ContinueStmnt); !ok {
+		t.Errorf("expected continue, got %T", clause.Block[0])
+	}
+	if c, ok := program[4].(*parser.CompoundAssignment); !ok || c.Op != lexer.PLUS {
+		t.Errorf("unexpected compound assignment %#v", program[4])
+	}
+	sign := program[6].(*parser.LocalAssignmentExpr)
+	if e, ok := sign.Exprs[0].(*parser.IfExpr); !ok {
+		t.Errorf("expected if expression, got %T", sign.Exprs[0])
+	} else if _, ok := e.Else.(*parser.IfExpr); !ok {
+		t.Errorf("expected elseif as nested if expression, got %T", e.Else)
+	}
+	nested := program[7].(*parser.LocalAssignmentExpr)
+	if args := nested.Types[0].(*parser.NamedType).Args; len(args) != 1 || len(args[0].(*parser.NamedType).Args) != 1 {
+		t.Errorf("unexpected nested type arguments %#v", nested.Types[0])
+	}
+	if _, ok := program[8].(*parser.CallExpr); !ok {
+		t.Errorf("expected a call to type, got %T", program[8])
+	}
+
+	var buf, ipl bytes.Buffer
+	program.AcceptVisitor(ast2json.NewJSONVisitor(&buf))
+	program.AcceptVisitor(ast2jsonipl.NewJSONVisitor(&ipl))
+	if !json.Valid(buf.Bytes()) || !json.Valid(ipl.Bytes()) {
+		t.Errorf("invalid JSON %s %s", buf.String(), ipl.String())
+	}
+	if !strings.Contains(ipl.String(), "\"ExpressionType\": \"Unsupported\"") {
+		t.Errorf("expected the Luau nodes unsupported by the IPL format, got %s", ipl.String())
+	}
+
+	// the nodes the IPL format has no form for are written as unsupported
+	lex = lex.New("repeat local t = {1, x = f.a, [2] = g[1]} do end until function() end")
+	tokens, _ = lex.Run()
+	p = parser.NewParser(tokens)
+	program, errs = p.Run()
+	ipl.Reset()
+	program.AcceptVisitor(ast2jsonipl.NewJSONVisitor(&ipl))
+	if len(errs) != 0 || !json.Valid(ipl.Bytes()) {
+		t.Errorf("invalid JSON %s %v", ipl.String(), errs)
+	}
+
+	lex = lex.New("count += 1")
+	tokens, _ = lex.Run()
+	p = parser.NewParser(tokens)
+	if _, errs := p.Run(); len(errs) == 0 {
+		t.Errorf("compound assignment accepted outside of Luau")
+	}
+}
+
+func TestLongBrackets(t *testing.T) {
+	src := "a = [==[\nx ]] ]=] y]==] --[=[ c ]] \n ]=] b = [[\n\nz]] --[==x\nc = t[ [[k]] ]"
+	var lex lexer.Lexer
+	lex = lex.New(src)
+	tokens, err := lex.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var strs []string
+	for _, token := range tokens {
+		if token.Type == lexer.STRING {
+			strs = append(strs, token.Val)
+		}
+	}
+	if len(strs) != 3 || strs[0] != "x ]] ]=] y" || strs[1] != "\nz" || strs[2] != "k" {
+		t.Errorf("unexpected strings %q", strs)
+	}
+	if last := tokens[len(tokens)-1]; last.Type != lexer.RBRACE || last.Start.Line != 6 {
+		t.Errorf("unexpected last token %v", last)
+	}
+
+	for src, msg := range map[string]string{
+		"s = [==[ abc ]=]":  "1:5: unfinished long string",
+		"x = 1 --[[ abc":    "1:7: unfinished long comment",
+		"s = [=  abc ]=]":   "1:5: invalid long string delimiter",
+		"s = [[ abc ]]\nt[": "",
+	} {
+		lex = lex.New(src)
+		_, err := lex.Run()
+		if (err == nil && msg != "") || (err != nil && err.Error() != msg) {
+			t.Errorf("%q: expected error %q, got %v", src, msg, err)
+		}
+	}
+}
+
+func TestStringEscapes(t *testing.T) {
+	cases := map[string]string{
+		`"a\nb\tc"`:             "a\nb\tc",
+		`'\65\066\0677'`:        "ABC7",
+		`"\x41\x7a\xFF"`:        "Az\xff",
+		`"\u{48}\u{e9}"`:        "Hé",
+		`"\u{7FFFFFFF}"`:        "\xfd\xbf\xbf\xbf\xbf\xbf",
+		`"\\ \" \' \a\v"`:       "\\ \" ' \a\v",
+		"'a\\z  \n  b'":         "ab",
+		"'a\\\r\nb'":            "a\nb",
+		`"[[no long]]"`:         "[[no long]]",
+		`"\0"`:                  "\x00",
+		"[[a\r\nb\n\rc\rd\ne]]": "a\nb\nc\nd\ne",
+		"[=[\r\n\r\r\n\n]=]":    "\n\n\n",
+	}
+	for src, expected := range cases {
+		var lex lexer.Lexer
+		lex = lex.New("s = " + src)
+		tokens, err := lex.Run()
+		if err != nil {
+			t.Errorf("%s: %v", src, err)
+			continue
+		}
+		if tokens[2].Val != expected || tokens[2].Raw != src {
+			t.Errorf("%s: expected %q, got %q with raw %q", src, expected, tokens[2].Val, tokens[2].Raw)
+		}
+	}
+
+	for src, msg := range map[string]string{
+		`s = "a\qb"`:         "1:7: invalid escape sequence '\\q'",
+		`s = "\256"`:         "1:6: decimal escape too large",
+		`s = "x\x4g"`:        "1:7: hexadecimal digit expected",
+		`s = "\u48"`:         "1:6: missing '{' in \\u{xxxx}",
+		`s = "\u{48"`:        "1:6: missing '}' in \\u{xxxx}",
+		`s = "\u{}"`:         "1:6: hexadecimal digit expected",
+		`s = "\u{80000000}"`: "1:6: UTF-8 value too large",
+		"s = 'ab\n'":         "1:5: unfinished string",
+	} {
+		var lex lexer.Lexer
+		lex = lex.New(src)
+		_, err := lex.Run()
+		if err == nil || err.Error() != msg {
+			t.Errorf("%q: expected error %q, got %v", src, msg, err)
+		}
+	}
+
+	var lex lexer.Lexer
+	lex = lex.New(`f(1 "a\n")`)
+	tokens, _ := lex.Run()
+	p := parser.NewParser(tokens)
+	_, errs := p.Run()
+	if len(errs) == 0 || !strings.Contains(errs[0].Error(), `found "a\n"`) {
+		t.Errorf("expected the raw string in the error, got %v", errs)
+	}
+
+	lex = lex.New("--[[a\r\nb\rc]]", lexer.WithTrivia())
+	if tokens, _ := lex.Run(); len(tokens) == 0 || tokens[0].Trivia == nil ||
+		tokens[0].Trivia.Leading[0].Val != "a\nb\nc" || tokens[0].Trivia.Leading[0].Raw != "--[[a\r\nb\rc]]" {
+		t.Errorf("expected the line breaks of a long comment normalized, got %v", tokens)
+	}
+}
+
+func TestNumbers(t *testing.T) {
+	integers := map[string]int64{
+		"0":                   0,
+		"0123":                123,
+		"0xff":                255,
+		"0XA1":                161,
+		"0x7fffffffffffffff":  math.MaxInt64,
+		"0xffffffffffffffff":  -1,
+		"9223372036854775807": math.MaxInt64,
+	}
+	floats := map[string]float64{
+		"3.":                  3,
+		".5":                  0.5,
+		"1e10":                1e10,
+		"2.5E-3":              2.5e-3,
+		"3e+2":                300,
+		"0x1.8p3":             12,
+		"0xA.8":               10.5,
+		"0x.1P4":              1,
+		"9223372036854775808": 9223372036854775808,
+		"1e400":               math.Inf(1),
+	}
+	lexNumber := func(src string) lexer.Token {
+		var lex lexer.Lexer
+		lex = lex.New("x = " + src)
+		tokens, err := lex.Run()
+		if err != nil || len(tokens) != 3 || tokens[2].Type != lexer.NUMBER || tokens[2].Val != src {
+			t.Fatalf("%s: unexpected tokens %v, error %v", src, tokens, err)
+		}
+		return tokens[2]
+	}
+	for src, expected := range integers {
+		if num := lexNumber(src).Num; !num.IsInteger || num.Int != expected {
+			t.Errorf("%s: expected integer %d, got %+v", src, expected, num)
+		}
+	}
+	for src, expected := range floats {
+		if num := lexNumber(src).Num; num.IsInteger || num.Float != expected {
+			t.Errorf("%s: expected float %g, got %+v", src, expected, num)
+		}
+	}
+
+	for src, msg := range map[string]string{
+		"x = 3..2":    "1:5: malformed number near '3..2'",
+		"x = 0xg":     "1:5: malformed number near '0xg'",
+		"x = 1e":      "1:5: malformed number near '1e'",
+		"x = 12abc":   "1:5: malformed number near '12abc'",
+		"x = 0x1p":    "1:5: malformed number near '0x1p'",
+		"x = 4 .. .5": "",
+		"x = t.y..1":  "",
+	} {
+		var lex lexer.Lexer
+		lex = lex.New(src)
+		_, err := lex.Run()
+		if (err == nil && msg != "") || (err != nil && err.Error() != msg) {
+			t.Errorf("%q: expected error %q, got %v", src, msg, err)
+		}
+	}
+
+	for src, expected := range map[string]string{
+		"18446744073709551615ULL": "18446744073709551615",
+		"0xffffffffffffffffull":   "18446744073709551615",
+		"9223372036854775807LL":   "9223372036854775807",
+		"9223372036854775808LL":   "-9223372036854775808",
+		"18446744073709551616ULL": "1:5: malformed number near '18446744073709551616ULL'",
+		"1.5LL":                   "1:5: malformed number near '1.5LL'",
+	} {
+		var lex lexer.Lexer
+		lex = lex.New("x = "+src, lexer.WithDialect(lexer.LuaJIT))
+		tokens, err := lex.Run()
+		if err != nil {
+			if err.Error() != expected {
+				t.Errorf("%s: expected %s, got error %v", src, expected, err)
+			}
+			continue
+		}
+		if num := tokens[2].Num; !num.IsInteger || num.String() != expected || num.IsUnsigned != strings.HasSuffix(strings.ToUpper(src), "ULL") {
+			t.Errorf("%s: expected the integer %s, got %+v", src, expected, num)
+		}
+	}
+}
+
+func TestNumberLiterals(t *testing.T) {
+	var lex lexer.Lexer
+	lex = lex.New("x = 0x10, 4.35, 1e2, 9007199254740993, 1e400, 0xffffffffffffffff")
+	tokens, _ := lex.Run()
+	p := parser.NewParser(tokens)
+	program, errs := p.Run()
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+
+	var buf bytes.Buffer
+	program.AcceptVisitor(ast2json.NewJSONVisitor(&buf))
+	var tree struct {
+		Statements []struct {
+			Expressions []struct {
+				ExpressionType string
+				Raw            string
+				IsInteger      bool
+				Value          interface{}
+			}
+		}
+	}
+	if err := json.Unmarshal(buf.Bytes(), &tree); err != nil {
+		t.Fatalf("invalid JSON %s: %v", buf.String(), err)
+	}
+	expected := []struct {
+		raw       string
+		isInteger bool
+		value     interface{}
+	}{
+		{"0x10", true, 16.0},
+		{"4.35", false, 4.35},
+		{"1e2", false, 100.0},
+		{"9007199254740993", true, "9007199254740993"},
+		{"1e400", false, "inf"},
+		{"0xffffffffffffffff", true, -1.0},
+	}
+	for i, e := range expected {
+		got := tree.Statements[0].Expressions[i]
+		if got.ExpressionType != "NumberLiteral" || got.Raw != e.raw || got.IsInteger != e.isInteger || got.Value != e.value {
+			t.Errorf("%s: unexpected %+v", e.raw, got)
+		}
+	}
+
+	lex = lex.New("x = 4.35")
+	tokens, _ = lex.Run()
+	p = parser.NewParser(tokens)
+	program, _ = p.Run()
+	buf.Reset()
+	program.AcceptVisitor(ast2jsonipl.NewJSONVisitor(&buf))
+	if !strings.Contains(buf.String(), `{"ExpressionType": "LiteralNumber","Value": 4.35}`) {
+		t.Errorf("expected a float LiteralNumber in %s", buf.String())
+	}
+
+	lex = lex.New("x = 2i, 2, 1.5I, 0x10LL, 18446744073709551615ULL", lexer.WithDialect(lexer.LuaJIT))
+	tokens, _ = lex.Run()
+	p = parser.NewParser(tokens, parser.WithDialect(lexer.LuaJIT))
+	program, _ = p.Run()
+	literals := program[0].(*parser.AssignmentExpr).Exprs
+	for i, imaginary := range []bool{true, false, true, false} {
+		if num := literals[i].(*parser.NumberLiteral); num.IsImaginary != imaginary {
+			t.Errorf("%s: expected IsImaginary %t, got %+v", num.Raw, imaginary, num.Number)
+		}
+	}
+	buf.Reset()
+	program.AcceptVisitor(ast2json.NewJSONVisitor(&buf))
+	if !strings.Contains(buf.String(), `"Raw": "2i","IsInteger": false,"IsImaginary": true,"Value": 2}`) ||
+		strings.Count(buf.String(), `"IsImaginary": true`) != 2 || !strings.Contains(buf.String(), `"Value": "18446744073709551615"`) {
+		t.Errorf("expected the imaginary numbers marked in %s", buf.String())
+	}
+	buf.Reset()
+	program.AcceptVisitor(ast2jsonipl.NewJSONVisitor(&buf))
+	if !strings.Contains(buf.String(), `{"ExpressionType": "LiteralNumber","IsImaginary": true,"Value": 2}`) {
+		t.Errorf("expected an imaginary LiteralNumber in %s", buf.String())
+	}
+}
+
+func TestJSONStrings(t *testing.T) {
+	src := `s = "q\"b\\s\n\t\1</script>" f(s, "\u{48}é", "\xff\xfe") x = 1 "\n"`
+	var lex lexer.Lexer
+	lex = lex.New(src)
+	tokens, err := lex.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := parser.NewParser(tokens, parser.WithRecovery())
+	program, _ := p.Run()
+
+	var buf bytes.Buffer
+	program.AcceptVisitor(ast2json.NewJSONVisitor(&buf))
+	var tree struct {
+		Statements []struct {
+			Expressions []struct{ Value interface{} }
+			Argument    struct {
+				Arguments []struct {
+					Value  string
+					Base64 string
+				}
+			}
+			Message string
+		}
+	}
+	if err := json.Unmarshal(buf.Bytes(), &tree); err != nil {
+		t.Fatalf("invalid JSON %s: %v", buf.String(), err)
+	}
+	if value := tree.Statements[0].Expressions[0].Value; value != "q\"b\\s\n\t\x01</script>" {
+		t.Errorf("unexpected value %q", value)
+	}
+	args := tree.Statements[1].Argument.Arguments
+	if len(args) != 3 || args[1].Value != "Hé" || args[1].Base64 != "" {
+		t.Fatalf("unexpected arguments %+v", args)
+	}
+	if raw, _ := base64.StdEncoding.DecodeString(args[2].Base64); args[2].Value != "��" || string(raw) != "\xff\xfe" {
+		t.Errorf("unexpected byte string %+v", args[2])
+	}
+	if msg := tree.Statements[3].Message; !strings.Contains(msg, `found "\n"`) {
+		t.Errorf("unexpected error message %q", msg)
+	}
+
+	buf.Reset()
+	program[:2].AcceptVisitor(ast2jsonipl.NewJSONVisitor(&buf))
+	if !json.Valid(buf.Bytes()) {
+		t.Errorf("invalid JSON %s", buf.String())
+	}
+}
+
+func TestLineBreaksAndColumns(t *testing.T) {
+	src := "a = 1\r\n\tb =\f2\v-- c\r\rc = 'x\\\r\ny'\n\rd = 4"
+	var lex lexer.Lexer
+	lex = lex.New(src)
+	tokens, err := lex.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []int
+	for _, token := range tokens {
+		if token.Type == lexer.IDENTIFIER {
+			lines = append(lines, token.Start.Line)
+		}
+	}
+	if fmt.Sprint(lines) != "[1 2 4 7]" {
+		t.Errorf("unexpected lines %v", lines)
+	}
+	if b := tokens[3]; b.Start.Col != 2 {
+		t.Errorf("expected b at column 2, got %v", b.Start)
+	}
+
+	src = "s = 'é😀' x = 1"
+	for unit, col := range map[lexer.ColumnUnit]int{lexer.Bytes: 14, lexer.Runes: 10, lexer.UTF16: 11} {
+		lex = lex.New(src, lexer.WithColumnUnit(unit))
+		tokens, _ := lex.Run()
+		if x := tokens[3]; x.Val != "x" || x.Start.Col != col || x.Start.Offset != 13 {
+			t.Errorf("unit %d: expected x at column %d, got %v", unit, col, x.Start)
+		}
+	}
+}
+
+func TestStreaming(t *testing.T) {
+	var sources []string
+	for _, name := range []string{"lexTest.txt", "parserTest.txt", "parserTestIPL.txt"} {
+		src, _ := ioutil.ReadFile(name)
+		sources = append(sources, string(src))
+	}
+	sources = append(sources,
+		"s = [==[\r\nlong ]] string]==] --[[ c\r\n]] n = 0x1p4 .. 'a\\z\r\n  b'\r\n",
+		"t = {"+strings.Repeat("{1, 'x', [[y]]}, -- item\n", 3000)+"}")
+
+	for _, src := range sources {
+		expected := assertStreamingEquivalent(t, src)
+
+		p := parser.NewParser(expected)
+		program, wantErrs := p.Run()
+		var want bytes.Buffer
+		program.AcceptVisitor(ast2json.NewJSONVisitorWithOptions(&want, ast2json.Options{Locations: true}))
+
+		var lex lexer.Lexer
+		lex = lex.NewReader(strings.NewReader(src))
+		p = parser.NewStreamParser(&lex)
+		program, errs := p.Run()
+		if fmt.Sprint(errs) != fmt.Sprint(wantErrs) {
+			t.Errorf("expected errors %v, got %v", wantErrs, errs)
+		}
+		var got bytes.Buffer
+		program.AcceptVisitor(ast2json.NewJSONVisitorWithOptions(&got, ast2json.Options{Locations: true}))
+		if got.String() != want.String() {
+			t.Errorf("streamed AST differs:\n%s\n%s", got.String(), want.String())
+		}
+	}
+
+	var lex lexer.Lexer
+	lex = lex.NewReader(strings.NewReader("x = 1\ny = 'a\\q'"))
+	p := parser.NewStreamParser(&lex)
+	_, errs := p.Run()
+	if len(errs) == 0 || errs[0].Error() != "2:7: invalid escape sequence '\\q'" {
+		t.Errorf("expected the lexical error first, got %v", errs)
+	}
+}
+
+// assertStreamingEquivalent lexes src with New and with NewReader reading a byte at a time
+// and fails unless both give the same tokens, peeked or not. It returns the tokens of New
+func assertStreamingEquivalent(t *testing.T, src string, opts ...lexer.Option) []lexer.Token {
+	t.Helper()
+	var lex lexer.Lexer
+	lex = lex.New(src, opts...)
+	tokens, err := lex.Run()
+	if err != nil {
+		t.Fatalf("%q: %v", src, err)
+	}
+	lex = lex.NewReader(iotest.OneByteReader(strings.NewReader(src)), opts...)
+	for i := 0; ; i++ {
+		if peeked, err := lex.Peek(1); err != nil || (i+1 < len(tokens) && !reflect.DeepEqual(peeked, tokens[i+1])) {
+			t.Fatalf("%q: token %d: peeked %v, error %v", src, i+1, peeked, err)
+		}
+		token, err := lex.Next()
+		if err != nil {
+			t.Fatalf("%q: %v", src, err)
+		}
+		if i == len(tokens) {
+			if token.Type != lexer.EOF {
+				t.Errorf("%q: expected EOF, got %v", src, token)
+			}
+			return tokens
+		}
+		if !reflect.DeepEqual(token, tokens[i]) {
+			t.Fatalf("%q: streamed token %d differs: %v %v", src, i, token, tokens[i])
+		}
+		if token.Type == lexer.EOF {
+			return tokens
+		}
+	}
+}
+
+func TestTrivia(t *testing.T) {
+	src := "-- doc\n--[[ more ]]\n\nlocal x = 1 -- one\nt = {\n  a = 1, -- first\n  -- second\n  b = 2\n}\n-- end"
+	tokens := assertStreamingEquivalent(t, src, lexer.WithTrivia())
+
+	var rebuilt strings.Builder
+	for _, token := range tokens {
+		for _, trivia := range token.Trivia.Leading {
+			rebuilt.WriteString(trivia.Raw)
+		}
+		rebuilt.WriteString(token.Raw)
+		for _, trivia := range token.Trivia.Trailing {
+			rebuilt.WriteString(trivia.Raw)
+		}
+	}
+	if rebuilt.String() != src {
+		t.Errorf("trivia do not cover the source:\n%q", rebuilt.String())
+	}
+
+	if last := tokens[len(tokens)-1]; last.Type != lexer.EOF || len(last.Trivia.Leading) != 2 {
+		t.Errorf("expected the final comment before EOF, got %v", last)
+	}
+
+	p := parser.NewParser(tokens)
+	program, errs := p.Run()
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	var buf bytes.Buffer
+	program.AcceptVisitor(ast2json.NewJSONVisitorWithOptions(&buf, ast2json.Options{Comments: true}))
+	type comments struct{ Leading, Trailing []string }
+	var tree struct {
+		Statements []struct {
+			Comments    *comments
+			Expressions []struct {
+				FieldList []struct{ Comments *comments }
+			}
+		}
+	}
+	if err := json.Unmarshal(buf.Bytes(), &tree); err != nil {
+		t.Fatalf("invalid JSON %s: %v", buf.String(), err)
+	}
+	local, assign := tree.Statements[0].Comments, tree.Statements[1]
+	if local == nil || fmt.Sprint(local.Leading) != "[-- doc --[[ more ]]]" || fmt.Sprint(local.Trailing) != "[-- one]" {
+		t.Errorf("unexpected comments on the local statement %+v", local)
+	}
+	fields := assign.Expressions[0].FieldList
+	if assign.Comments == nil || len(assign.Comments.Leading) != 0 || fmt.Sprint(assign.Comments.Trailing) != "[-- end]" ||
+		fields[0].Comments == nil || fmt.Sprint(fields[0].Comments.Trailing) != "[-- first]" ||
+		fields[1].Comments == nil || fmt.Sprint(fields[1].Comments.Leading) != "[-- second]" {
+		t.Errorf("unexpected comments on the table %s", buf.String())
+	}
+}
+
+func TestCommentPositions(t *testing.T) {
+	src := "local function f(a, -- param\n  b)\n  do -- after do\n    g(1, -- in args\n      2)\n  end\n" +
+		"  if a then -- after then\n    x = a + -- in expr\n      b\n    -- before end\n  end\n" +
+		"  return -- after return\n    a\nend\n-- eof\n"
+	var lex lexer.Lexer
+	lex = lex.New(src, lexer.WithTrivia())
+	tokens, err := lex.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := parser.NewParser(tokens)
+	program, errs := p.Run()
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	raw := func(comments []lexer.Token) string {
+		var texts []string
+		for _, comment := range comments {
+			texts = append(texts, comment.Raw)
+		}
+		return fmt.Sprint(texts)
+	}
+	inner := func(n parser.Node) string {
+		if c := n.NodeSpan().Comments; c != nil {
+			return raw(c.Inner)
+		}
+		return "[]"
+	}
+	f := program[0].(*parser.LocalFunction)
+	do := f.Body[0].(*parser.DoStmnt)
+	ifStmnt := f.Body[1].(*parser.IfStmnt)
+	clause := ifStmnt.Clauses.(*parser.ArgList).Args[0].(*parser.IfClause)
+	assign := clause.Block[0].(*parser.AssignmentExpr)
+	tests := []struct {
+		node     parser.Node
+		expected string
+	}{
+		{f.Parameters, "[-- param]"},
+		{do, "[-- after do]"},
+		{do.Block[0].(*parser.CallExpr).Arguments, "[-- in args]"},
+		{clause, "[-- after then]"},
+		{assign.Exprs[0], "[-- in expr]"},
+		{ifStmnt, "[-- before end]"},
+		{f.Body[2], "[-- after return]"},
+	}
+	for _, test := range tests {
+		if got := inner(test.node); got != test.expected {
+			t.Errorf("expected the comments %s inside %T, got %s", test.expected, test.node, got)
+		}
+	}
+	if c := f.Comments; c == nil || raw(c.Trailing) != "[-- eof]" {
+		t.Errorf("expected the comment at the end of the source to trail the function, got %+v", c)
+	}
+
+	var buf bytes.Buffer
+	program.AcceptVisitor(ast2json.NewJSONVisitorWithOptions(&buf, ast2json.Options{Comments: true}))
+	for _, comment := range []string{"param", "after do", "in args", "after then", "in expr", "before end", "after return", "eof"} {
+		if n := strings.Count(buf.String(), "\"-- "+comment+"\""); n != 1 {
+			t.Errorf("expected the comment %q once in the JSON, got %d times", comment, n)
+		}
+	}
+}
+
+func TestCST(t *testing.T) {
+	sources := []string{
+		"-- head\r\nlocal s = [==[\r\nlong]==] .. 'a\\tb' --[[ c ]]\r\nx = (a + b) * c;;\n\tfunction t.m:f(y, ...) return y, ... end -- tail\n",
+	}
+	for _, name := range []string{"lexTest.txt", "parserTest.txt", "parserTestIPL.txt", "parserTestIPL2.txt"} {
+		src, _ := ioutil.ReadFile(name)
+		sources = append(sources, string(src))
+	}
+	for i, src := range sources {
+		var lex lexer.Lexer
+		lex = lex.New(src, lexer.WithTrivia())
+		tokens, err := lex.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree, _ := parser.ParseCST(tokens)
+		if printed := tree.String(); printed != src {
+			t.Errorf("source %d is not printed back:\n%q", i, printed)
+		}
+		if len(tree.Tokens()) != len(tokens) {
+			t.Errorf("source %d: expected %d tokens, got %d", i, len(tokens), len(tree.Tokens()))
+		}
+		checkParens(t, tree)
+	}
+
+	var lex lexer.Lexer
+	src := "local function f<T>(a: T, b: (T) -> ()): T?\n  return (a :: any)\nend\n"
+	lex = lex.New(src, lexer.WithTrivia(), lexer.WithDialect(lexer.Luau))
+	tokens, _ := lex.Run()
+	tree, errs := parser.ParseCST(tokens, parser.WithDialect(lexer.Luau))
+	if len(errs) != 0 || tree.String() != src {
+		t.Errorf("the Luau source is not printed back: %v\n%q", errs, tree.String())
+	}
+	checkParens(t, tree)
+	params := tree.Children[0].Node.Children[1].Node.Children[5].Node
+	if _, ok := params.Node.(*parser.ArgList); !ok || len(params.Children) != 9 || params.Children[3].Node == nil {
+		t.Errorf("expected the parameter types in the parameter list, got %+v", params)
+	}
+
+	lex = lex.New(sources[0], lexer.WithTrivia())
+	tokens, _ = lex.Run()
+	tree, errs = parser.ParseCST(tokens)
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	assign := tree.Children[1].Node
+	product := assign.Children[2].Node
+	paren := product.Children[0].Node
+	if _, ok := product.Node.(*parser.BinExpr); !ok || paren == nil {
+		t.Fatalf("expected the parenthesized sum in the product node, got %+v", product)
+	}
+	if _, ok := paren.Node.(*parser.ParenExpr); !ok || paren.Children[0].Token.Val != "(" || paren.Children[2].Token.Val != ")" {
+		t.Errorf("expected the parentheses in the parenthesized node, got %+v", paren)
+	}
+
+	var original, derived bytes.Buffer
+	tree.Node.AcceptVisitor(ast2json.NewJSONVisitor(&original))
+	program, errs := tree.AST()
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	program.AcceptVisitor(ast2json.NewJSONVisitor(&derived))
+	if original.String() != derived.String() {
+		t.Errorf("the derived AST differs:\n%s\n%s", original.String(), derived.String())
+	}
+
+	target := &assign.Children[0].Node.Children[0].Token
+	target.Val, target.Raw = "z", "z"
+	op := &product.Children[1].Token
+	op.Type, op.Val, op.Raw = lexer.DIV, "/", "/"
+	if printed := tree.String(); !strings.Contains(printed, "\r\nz = (a + b) / c;;") {
+		t.Errorf("the edits are not printed:\n%q", printed)
+	}
+	program, _ = tree.AST()
+	edited := program[1].(*parser.AssignmentExpr)
+	if name := edited.Vars[0].(*parser.Identifier).Name; name != "z" {
+		t.Errorf("the edit is not in the AST, got %s", name)
+	}
+	if e := edited.Exprs[0].(*parser.BinExpr); e.Op != lexer.DIV || e.Left.(*parser.ParenExpr).Expr.(*parser.BinExpr).Op != lexer.PLUS {
+		t.Errorf("expected the edited operator in the AST, got %v and %v", e.Op, e.Left.(*parser.ParenExpr).Expr.(*parser.BinExpr).Op)
+	}
+	if name := tree.Node.(parser.Program)[1].(*parser.AssignmentExpr).Vars[0].(*parser.Identifier).Name; name != "x" {
+		t.Errorf("expected the nodes of the tree untouched, got %s", name)
+	}
+
+	edits := []struct {
+		dialect lexer.Dialect
+		src     string
+		from    string
+		to      lexer.Token
+		check   func(parser.Program) bool
+	}{
+		{lexer.Lua54, "local x <const> = f()", "const", lexer.Token{Type: lexer.IDENTIFIER, Val: "close", Raw: "close"},
+			func(p parser.Program) bool { return p[0].(*parser.LocalAssignmentExpr).Attribs[0] == "close" }},
+		{lexer.Luau, "x += 1", "+=", lexer.Token{Type: lexer.MINUSASSIGN, Val: "-=", Raw: "-="},
+			func(p parser.Program) bool { return p[0].(*parser.CompoundAssignment).Op == lexer.MINUS }},
+		{lexer.Lua54, "function a:b() end", ":", lexer.Token{Type: lexer.DOT, Val: ".", Raw: "."},
+			func(p parser.Program) bool { return !p[0].(*parser.NamedFunction).IsMethod }},
+		{lexer.Lua54, "a:b()", ":", lexer.Token{Type: lexer.DOT, Val: ".", Raw: "."},
+			func(p parser.Program) bool { _, ok := p[0].(*parser.CallExpr); return ok }},
+	}
+	for _, edit := range edits {
+		lex = lex.New(edit.src, lexer.WithTrivia(), lexer.WithDialect(edit.dialect))
+		tokens, _ = lex.Run()
+		tree, _ := parser.ParseCST(tokens, parser.WithDialect(edit.dialect))
+		if !editToken(tree, edit.from, edit.to) {
+			t.Fatalf("%q: no token %q", edit.src, edit.from)
+		}
+		program, errs := tree.AST()
+		if len(errs) != 0 || !edit.check(program) {
+			t.Errorf("%q: the edit to %q is not in the AST %v, errors %v", edit.src, edit.to.Val, program, errs)
+		}
+	}
+}
+
+// editToken replaces the first token of the tree whose Val is val with to, keeping its trivia
+func editToken(tree *parser.CST, val string, to lexer.Token) bool {
+	for i := range tree.Children {
+		child := &tree.Children[i]
+		if child.Node != nil {
+			if editToken(child.Node, val, to) {
+				return true
+			}
+		} else if child.Token.Val == val {
+			child.Token.Type, child.Token.Val, child.Token.Raw = to.Type, to.Val, to.Raw
+			return true
+		}
+	}
+	return false
+}
+
+// checkParens fails when a CST node holds only one of a pair of parentheses
+func checkParens(t *testing.T, tree *parser.CST) {
+	depth := 0
+	for _, child := range tree.Children {
+		switch {
+		case child.Node != nil:
+			checkParens(t, child.Node)
+		case child.Token.Type == lexer.LPAR:
+			depth++
+		case child.Token.Type == lexer.RPAR:
+			depth--
+		}
+		if depth < 0 {
+			break
+		}
+	}
+	if depth != 0 {
+		t.Errorf("unbalanced parentheses in the CST node of %T at %v", tree.Node, tree.Node.NodeSpan().Start)
+	}
+}
+
+func TestShebang(t *testing.T) {
+	tests := []struct {
+		src, shebang string
+		line         int
+	}{
+		{"#!/usr/bin/env lua\nprint(1)", "#!/usr/bin/env lua", 2},
+		{"\uFEFF#!/usr/bin/lua -i\r\nprint(1)", "#!/usr/bin/lua -i", 2},
+		{"# any first line\nprint(1)", "# any first line", 2},
+		{"\uFEFFprint(1)", "", 1},
+	}
+	for _, test := range tests {
+		tokens := assertStreamingEquivalent(t, test.src)
+		if ok := tokens[0].Type == lexer.SHEBANG; ok != (test.shebang != "") {
+			t.Errorf("%q: unexpected first token %v", test.src, tokens[0])
+		}
+
+		p := parser.NewParser(tokens)
+		program, errs := p.Run()
+		if len(errs) != 0 {
+			t.Fatalf("%q: %v", test.src, errs)
+		}
+		shebang := p.Shebang()
+		ok := shebang != ""
+		if shebang != test.shebang {
+			t.Errorf("%q: expected shebang %q, got %q", test.src, test.shebang, shebang)
+		}
+		if len(program) != 1 {
+			t.Fatalf("%q: expected the call alone in the program, got %v", test.src, program)
+		}
+		if line := program[0].NodeSpan().Start.Line; line != test.line {
+			t.Errorf("%q: expected the call on line %d, got %d", test.src, test.line, line)
+		}
+
+		var buf bytes.Buffer
+		program.AcceptVisitor(ast2json.NewJSONVisitorWithOptions(&buf, ast2json.Options{Shebang: shebang}))
+		var tree struct {
+			Shebang    *string
+			Statements []interface{}
+		}
+		if err := json.Unmarshal(buf.Bytes(), &tree); err != nil {
+			t.Fatalf("invalid JSON %s: %v", buf.String(), err)
+		}
+		if len(tree.Statements) != 1 || (tree.Shebang == nil) == ok || ok && *tree.Shebang != test.shebang {
+			t.Errorf("%q: unexpected JSON %s", test.src, buf.String())
+		}
+
+		tokens = assertStreamingEquivalent(t, test.src, lexer.WithTrivia())
+		if tree, _ := parser.ParseCST(tokens); tree.String() != test.src {
+			t.Errorf("%q is not printed back: %q", test.src, tree.String())
+		}
+	}
+
+	for _, src := range []string{"x = 1\n#!/usr/bin/env lua", " #!/bin/lua\nprint(1)", "\n#!/bin/lua\nprint(1)"} {
+		for _, opts := range [][]lexer.Option{nil, {lexer.WithTrivia()}} {
+			var lex lexer.Lexer
+			lex = lex.New(src, opts...)
+			tokens, err := lex.Run()
+			for _, token := range tokens {
+				if token.Type == lexer.SHEBANG {
+					t.Errorf("%q with %d options: unexpected shebang %q", src, len(opts), token.Val)
+				}
+			}
+			failed := err != nil
+			if !failed {
+				p := parser.NewParser(tokens)
+				_, errs := p.Run()
+				failed = len(errs) != 0
+			}
+			if !failed {
+				t.Errorf("%q with %d options: expected an error for a shebang not at the start of the source", src, len(opts))
+			}
+		}
+	}
+}
+
+func TestUnicode(t *testing.T) {
+	src := "local café, ñ2 = 1, 'ü' -- ß\nprint(café + ñ2)"
+	var lex lexer.Lexer
+	lex = lex.New(src)
+	tokens, _ := lex.Run()
+	p := parser.NewParser(tokens)
+	if _, errs := p.Run(); len(errs) == 0 {
+		t.Error("expected Unicode identifiers to be rejected by default")
+	}
+
+	opts := []lexer.Option{lexer.WithUnicodeIdentifiers(), lexer.WithColumnUnit(lexer.Runes), lexer.WithUTF8Validation()}
+	tokens = assertStreamingEquivalent(t, src, opts...)
+	if tokens[1].Val != "café" || tokens[2].Start != (lexer.Position{Line: 1, Col: 11, Offset: 11}) || tokens[3].Val != "ñ2" {
+		t.Errorf("unexpected tokens %v", tokens[:4])
+	}
+	p = parser.NewParser(tokens)
+	if _, errs := p.Run(); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+
+	for _, src := range []string{"x = 1é", "x = €"} {
+		lex = lex.New(src, lexer.WithUnicodeIdentifiers())
+		tokens, err := lex.Run()
+		if err == nil {
+			p := parser.NewParser(tokens)
+			_, errs := p.Run()
+			if len(errs) == 0 {
+				t.Errorf("%q: expected an error", src)
+			}
+		}
+	}
+
+	tests := []struct {
+		src string
+		err string
+	}{
+		{"s = 'ok' -- fine\nt = 'é\xff'", "2:7: invalid UTF-8 in string"},
+		{"x = 1 --[[ é\n\xfe ]]", "2:1: invalid UTF-8 in comment"},
+		{"s = '\\xff\\u{7FFFFFFF}'", ""},
+	}
+	for _, test := range tests {
+		lex = lex.New(test.src, lexer.WithColumnUnit(lexer.Runes))
+		if _, err := lex.Run(); err != nil {
+			t.Errorf("%q: unexpected error without validation: %v", test.src, err)
+		}
+		lex = lex.New(test.src, lexer.WithColumnUnit(lexer.Runes), lexer.WithUTF8Validation())
+		_, err := lex.Run()
+		if fmt.Sprint(err) != test.err && !(err == nil && test.err == "") {
+			t.Errorf("%q: expected error %q, got %v", test.src, test.err, err)
+		}
+		if _, ok := err.(*lexer.Error); err != nil && !ok {
+			t.Errorf("%q: expected a *lexer.Error, got %T", test.src, err)
+		}
+	}
+}
+
+// parenthesize renders an expression with explicit parentheses to check its structure
+func parenthesize(n parser.Node) string {
+	switch e := n.(type) {
+	case *parser.BinExpr:
+		return fmt.Sprintf("(%s %s %s)", parenthesize(e.Left), e.Op, parenthesize(e.Right))
+	case *parser.UnaryExpr:
+		return fmt.Sprintf("(%s %s)", e.Op, parenthesize(e.Operand))
+	case *parser.ParenExpr:
+		return parenthesize(e.Expr)
+	case *parser.SimpleExpr:
+		return e.Val
+	case *parser.NumberLiteral:
+		return e.Raw
+	case *parser.Identifier:
+		return e.Name
+	}
+	return fmt.Sprintf("%T", n)
+}
+
+func parseExpr(t *testing.T, src string) string {
+	var lex lexer.Lexer
+	lex = lex.New("x = " + src)
+	tokens, _ := lex.Run()
+	p := parser.NewParser(tokens)
+	program, errs := p.Run()
+	if len(errs) != 0 {
+		t.Fatalf("%s: %v", src, errs)
+	}
+	return parenthesize(program[0].(*parser.AssignmentExpr).Exprs[0])
+}
+
+func TestPrecedence(t *testing.T) {
+	cases := map[string]string{
+		"1 + 2 * 3":             "(1 + (2 * 3))",
+		"1 - 2 - 3":             "((1 - 2) - 3)",
+		"a % b + c":             "((a % b) + c)",
+		"2 ^ 3 ^ 2":             "(2 ^ (3 ^ 2))",
+		"a .. b .. c":           "(a .. (b .. c))",
+		"a + b .. c":            "((a + b) .. c)",
+		"not a == b":            "((not a) == b)",
+		"#t * 2":                "((# t) * 2)",
+		"not a ^ b":             "(not (a ^ b))",
+		"a or b and c < d":      "(a or (b and (c < d)))",
+		"a < b .. c":            "(a < (b .. c))",
+		"a ~= b and c":          "((a ~= b) and c)",
+		"(a + b) * c":           "((a + b) * c)",
+		"f(a) + t.x * t[1] ^ 2": "(*parser.CallExpr + (*parser.MemberExpr * (*parser.IndexExpr ^ 2)))",
+	}
+	for src, expected := range cases {
+		if got := parseExpr(t, src); got != expected {
+			t.Errorf("%s: expected %s, got %s", src, expected, got)
+		}
+	}
+}
+
+func TestUnaryMinus(t *testing.T) {
+	cases := map[string]string{
+		"-1":          "(- 1)",
+		"- - x":       "(- (- x))",
+		"-x ^ 2":      "(- (x ^ 2))",
+		"a * -b":      "(a * (- b))",
+		"a - -b":      "(a - (- b))",
+		"2 ^ -3":      "(2 ^ (- 3))",
+		"-a + b":      "((- a) + b)",
+		"-f(x).y":     "(- *parser.MemberExpr)",
+		"not -x":      "(not (- x))",
+		"-2 .. 3 - 1": "((- 2) .. (3 - 1))",
+	}
+	for src, expected := range cases {
+		if got := parseExpr(t, src); got != expected {
+			t.Errorf("%s: expected %s, got %s", src, expected, got)
+		}
+	}
+
+	var lex lexer.Lexer
+	lex = lex.New("x = -y")
+	tokens, _ := lex.Run()
+	p := parser.NewParser(tokens)
+	program, _ := p.Run()
+	unary, ok := program[0].(*parser.AssignmentExpr).Exprs[0].(*parser.UnaryExpr)
+	if !ok || unary.Op != lexer.UMINUS || unary.Start.Col != 5 {
+		t.Errorf("expected UMINUS unary expression, got %#v", program[0].(*parser.AssignmentExpr).Exprs[0])
+	}
+}
+
+func TestBitwiseOperators(t *testing.T) {
+	cases := map[string]string{
+		"a // b * c":      "((a // b) * c)",
+		"a | b ~ c & d":   "(a | (b ~ (c & d)))",
+		"a << 1 .. b":     "(a << (1 .. b))",
+		"a >> b << c":     "((a >> b) << c)",
+		"~a & b":          "((~ a) & b)",
+		"a ~ ~b":          "(a ~ (~ b))",
+		"a < b | c":       "(a < (b | c))",
+		"a ~= b ~ c":      "(a ~= (b ~ c))",
+		"1 + 2 << 3 // 4": "((1 + 2) << (3 // 4))",
+	}
+	for src, expected := range cases {
+		if got := parseExpr(t, src); got != expected {
+			t.Errorf("%s: expected %s, got %s", src, expected, got)
+		}
+	}
+}
+
+func TestParentheses(t *testing.T) {
+	// a parenthesized expression is a value, neither a variable nor a call statement
+	for _, src := range []string{"(a) = 1", "(f())", "x, (t.y) = 1, 2"} {
+		var lex lexer.Lexer
+		lex = lex.New(src)
+		tokens, _ := lex.Run()
+		p := parser.NewParser(tokens)
+		if _, errs := p.Run(); len(errs) == 0 {
+			t.Errorf("%q: expected an error", src)
+		} else if _, ok := errs[0].(*parser.SyntaxError); !ok {
+			t.Errorf("%q: expected a SyntaxError, got %v", src, errs[0])
+		}
+	}
+
+	// the parentheses truncate the results of a call to one value
+	toJSON := func(src string) string {
+		var lex lexer.Lexer
+		lex = lex.New(src)
+		tokens, _ := lex.Run()
+		p := parser.NewParser(tokens)
+		program, errs := p.Run()
+		if len(errs) != 0 {
+			t.Fatalf("%q: %v", src, errs)
+		}
+		var buf bytes.Buffer
+		program.AcceptVisitor(ast2json.NewJSONVisitor(&buf))
+		return buf.String()
+	}
+	paren, call := toJSON("return (f())"), toJSON("return f()")
+	if paren == call || !strings.Contains(paren, "\"ExpressionType\": \"ParenExpression\"") {
+		t.Errorf("expected the parentheses in the JSON, got %s", paren)
+	}
+}